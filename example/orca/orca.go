@@ -0,0 +1,122 @@
+// Package orca publishes the load of a server with ORCA (Open Request Cost Aggregation), the reports that clients using
+// weighted round robin (gRPC A58) weigh the endpoints by. The load is reported in the trailers of each call, and out of
+// band to clients that subscribe to the OpenRcaService. Clients that do not support weighted round robin, like gRPC-Go
+// 1.46, ignore the reports.
+package orca
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	orcadata "github.com/cncf/xds/go/xds/data/orca/v3"
+	orcaservice "github.com/cncf/xds/go/xds/service/orca/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// trailerKey is the trailer of the per call load reports
+const trailerKey = "endpoint-load-metrics-bin"
+
+// window over which the load is measured
+const window = time.Second
+
+// minReportInterval bounds the out of band reports that clients request
+const minReportInterval = time.Second
+
+// handlerCost is the request cost with the seconds spent in the handlers
+const handlerCost = "handler_seconds"
+
+// Recorder measures the load of the server: the calls per second, and the time spent in the handlers. The handler time
+// includes the time that handlers wait, like the delay of the example server, so it is reported as a request cost (the
+// average per call) and not as CPU utilization.
+type Recorder struct {
+	mu       sync.Mutex
+	start    time.Time
+	busy     time.Duration
+	requests uint64
+	last     *orcadata.OrcaLoadReport
+}
+
+func (r *Recorder) record(busy time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotate()
+	r.busy += busy
+	r.requests++
+}
+
+// rotate completes the window once it passed
+func (r *Recorder) rotate() {
+	now := time.Now()
+	if r.start.IsZero() {
+		r.start = now
+	}
+	elapsed := now.Sub(r.start)
+	if elapsed < window {
+		return
+	}
+	r.last = &orcadata.OrcaLoadReport{Rps: uint64(float64(r.requests) / elapsed.Seconds())}
+	if r.requests > 0 {
+		r.last.RequestCost = map[string]float64{handlerCost: r.busy.Seconds() / float64(r.requests)}
+	}
+	r.start, r.busy, r.requests = now, 0, 0
+}
+
+// Report is the load of the last window
+func (r *Recorder) Report() *orcadata.OrcaLoadReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotate()
+	if r.last == nil {
+		return &orcadata.OrcaLoadReport{}
+	}
+	return proto.Clone(r.last).(*orcadata.OrcaLoadReport)
+}
+
+// UnaryServerInterceptor records the calls, and reports the load in their trailers, with the cost of the call itself
+func (r *Recorder) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		busy := time.Since(start)
+		r.record(busy)
+		load := r.Report()
+		load.RequestCost = map[string]float64{handlerCost: busy.Seconds()}
+		if report, marshalErr := proto.Marshal(load); marshalErr == nil {
+			_ = grpc.SetTrailer(ctx, metadata.Pairs(trailerKey, string(report)))
+		}
+		return resp, err
+	}
+}
+
+// Register the OpenRcaService, which streams the load to the clients at the interval they request. The generated
+// registration of cncf/xds takes a *grpc.Server, so the xDS enabled server (gRPC-Go 1.46) only reports in the trailers.
+func Register(s *grpc.Server, r *Recorder) {
+	orcaservice.RegisterOpenRcaServiceServer(s, &service{recorder: r})
+}
+
+type service struct {
+	orcaservice.UnimplementedOpenRcaServiceServer
+	recorder *Recorder
+}
+
+func (s *service) StreamCoreMetrics(req *orcaservice.OrcaLoadReportRequest, stream orcaservice.OpenRcaService_StreamCoreMetricsServer) error {
+	interval := req.GetReportInterval().AsDuration()
+	if interval < minReportInterval {
+		interval = minReportInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := stream.Send(s.recorder.Report()); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
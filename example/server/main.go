@@ -8,23 +8,57 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"time"
 
+	"github.com/hermanbanken/k8s-xds/example/orca"
 	examplev1 "github.com/hermanbanken/k8s-xds/example/pkg/gen/v1"
 	"github.com/hermanbanken/k8s-xds/example/trace"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	xdscreds "google.golang.org/grpc/credentials/xds"
+	"google.golang.org/grpc/xds"
 )
 
 var cleanupTracing = trace.InstallExportPipeline(context.Background(), "server")
 
+var useXds = flag.Bool("xds", false, "serve using the inbound listener of the xDS server configured in GRPC_XDS_BOOTSTRAP")
+var delay = flag.Duration("delay", 0, "slow down each call, which shows in the handler time reported with ORCA")
+
+type server interface {
+	grpc.ServiceRegistrar
+	Serve(lis net.Listener) error
+	GracefulStop()
+}
+
 func main() {
 	flag.Parse()
-	grpcServer := grpc.NewServer(
-		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+	// publish the load with ORCA, for clients using weighted round robin
+	recorder := &orca.Recorder{}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), recorder.UnaryServerInterceptor()),
 		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
-	)
-	examplev1.RegisterExampleServer(grpcServer, example{})
+	}
+	var grpcServer server
+	if *useXds {
+		// Use mutual TLS when the control plane configures it, plaintext otherwise
+		creds, err := xdscreds.NewServerCredentials(xdscreds.ServerOptions{FallbackCreds: insecure.NewCredentials()})
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, grpc.Creds(creds), xds.ServingModeCallback(func(addr net.Addr, args xds.ServingModeChangeArgs) {
+			zap.L().Info("Serving mode changed", zap.Stringer("addr", addr), zap.Stringer("mode", args.Mode), zap.Error(args.Err))
+		}))
+		grpcServer = xds.NewGRPCServer(opts...)
+	} else {
+		grpcServer = grpc.NewServer(opts...)
+	}
+	hostname, _ := os.Hostname()
+	examplev1.RegisterExampleServer(grpcServer, example{hostname: hostname, delay: *delay})
+	if s, ok := grpcServer.(*grpc.Server); ok {
+		orca.Register(s, recorder)
+	}
 	zap.L().Info("Listening on :9090")
 	lis, err := net.Listen("tcp", ":9090")
 	if err != nil {
@@ -45,8 +79,11 @@ func main() {
 
 type example struct {
 	examplev1.UnimplementedExampleServer
+	hostname string
+	delay    time.Duration
 }
 
-func (example) DoSomething(ctx context.Context, req *examplev1.ExampleRequest) (*examplev1.ExampleResponse, error) {
-	return &examplev1.ExampleResponse{Message: fmt.Sprintf("Hi %s", req.Name)}, nil
+func (e example) DoSomething(ctx context.Context, req *examplev1.ExampleRequest) (*examplev1.ExampleResponse, error) {
+	time.Sleep(e.delay)
+	return &examplev1.ExampleResponse{Message: fmt.Sprintf("Hi %s from %s", req.Name, e.hostname)}, nil
 }
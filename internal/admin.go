@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// defaultAdminAddress keeps the admin API local to the Pod unless another address is configured
+const defaultAdminAddress = "localhost"
+
+// RunAdminServer starts the HTTP admin API at the given address and port, an empty address listens on localhost.
+func RunAdminServer(ctx context.Context, handler http.Handler, address string, port uint) {
+	if address == "" {
+		address = defaultAdminAddress
+	}
+	server := &http.Server{Handler: handler}
+	lis, err := net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	if err != nil {
+		zap.L().Error("Failed to listen", zap.Error(err))
+		return
+	}
+
+	zap.L().Info("Admin server listening", zap.String("address", address), zap.Uint("port", port))
+	go func() {
+		if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			zap.L().Error("Failed to start admin server", zap.Error(err))
+		}
+	}()
+	<-ctx.Done()
+
+	server.Close()
+}
+
+// requireToken makes the requests that change state, like starting fault experiments, require the bearer token. Reads,
+// like the health checks that the peers fetch, are allowed without it. An empty token allows all requests.
+func requireToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(rw, "missing or invalid admin token", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		zap.L().Warn("Failed to write response", zap.Error(err))
+	}
+}
@@ -0,0 +1,408 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"go.uber.org/zap"
+)
+
+// adsAckTimeout bounds the wait for the acknowledgement of a push, after which the next stage is pushed anyway
+const adsAckTimeout = 5 * time.Second
+
+// pushStage is a snapshot in which a single resource type changed
+type pushStage struct {
+	snapshot *cache.Snapshot
+	typeURL  resource.Type
+}
+
+// orderedSnapshots splits the change from the previous to the next snapshot into stages, pushed in the make before break
+// order of the xDS protocol: new clusters and endpoints first, then listeners and routes, so a route never refers to a
+// cluster the client does not have yet. Stale clusters and endpoints are removed last.
+func orderedSnapshots(previous, next *cache.Snapshot) ([]pushStage, error) {
+	if previous == nil {
+		return []pushStage{{snapshot: next}}, nil
+	}
+	current := map[resource.Type][]types.Resource{}
+	versions := map[resource.Type]string{}
+	for _, typ := range []resource.Type{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType} {
+		current[typ] = resourceList(previous.GetResources(typ))
+		versions[typ] = previous.GetVersion(typ)
+	}
+
+	ttls := snapshotTTLs(next)
+	var stages []pushStage
+	step := func(typ resource.Type, items []types.Resource) error {
+		version, err := contentVersion(items)
+		if err != nil || version == versions[typ] {
+			return err
+		}
+		current[typ] = items
+		versions[typ] = version
+		ss, err := newSnapshot(current, ttls)
+		if err != nil {
+			return err
+		}
+		stages = append(stages, pushStage{snapshot: ss, typeURL: typ})
+		return nil
+	}
+	steps := []struct {
+		typ   resource.Type
+		items []types.Resource
+	}{
+		{resource.ClusterType, resourceUnion(previous.GetResources(resource.ClusterType), next.GetResources(resource.ClusterType))},
+		{resource.EndpointType, resourceUnion(previous.GetResources(resource.EndpointType), next.GetResources(resource.EndpointType))},
+		{resource.ListenerType, resourceList(next.GetResources(resource.ListenerType))},
+		{resource.RouteType, resourceList(next.GetResources(resource.RouteType))},
+		{resource.ClusterType, resourceList(next.GetResources(resource.ClusterType))},
+		{resource.EndpointType, resourceList(next.GetResources(resource.EndpointType))},
+	}
+	for _, s := range steps {
+		if err := step(s.typ, s.items); err != nil {
+			return nil, err
+		}
+	}
+	return stages, nil
+}
+
+func resourceList(resources map[string]types.Resource) []types.Resource {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]types.Resource, 0, len(names))
+	for _, name := range names {
+		list = append(list, resources[name])
+	}
+	return list
+}
+
+// resourceUnion keeps the previous resources that are no longer in next
+func resourceUnion(previous, next map[string]types.Resource) []types.Resource {
+	union := make(map[string]types.Resource, len(next))
+	for name, r := range previous {
+		union[name] = r
+	}
+	for name, r := range next {
+		union[name] = r
+	}
+	return resourceList(union)
+}
+
+// classCache is the snapshot cache of a class of nodes. Clients using a stream per type get the snapshot of the class,
+// as the order of independent streams can not be guaranteed. The change of the class is split into stages once, and
+// each ADS stream follows these stages in make before break order, at the pace of the acknowledgements of that stream
+// only. The snapshots are keyed by node ID: the requests get the ID of the class, or that of their ADS stream.
+type classCache struct {
+	cache.SnapshotCache
+	ctx   context.Context
+	class string
+	ads   *adsStreams
+	mu    sync.Mutex
+	// stages of the last change of the class
+	stages  []pushStage
+	streams map[streamKey]*adsStage
+}
+
+// adsStage is the stage of the class that an ADS stream has
+type adsStage struct {
+	node  *core.Node
+	index int
+	// timer pushes the next stage if the stream does not acknowledge the current one in time
+	timer *time.Timer
+}
+
+// idHash keys the snapshots of a classCache by the node ID
+type idHash struct{}
+
+func (idHash) ID(node *core.Node) string {
+	return node.GetId()
+}
+
+// SetSnapshot sets the snapshot of the class, and restarts the ADS streams at the first stage of the change
+func (c *classCache) SetSnapshot(ctx context.Context, node string, snapshot cache.ResourceSnapshot) error {
+	ss, ok := snapshot.(*cache.Snapshot)
+	if !ok {
+		return c.SnapshotCache.SetSnapshot(ctx, c.class, snapshot)
+	}
+	var previous *cache.Snapshot
+	if current, err := c.SnapshotCache.GetSnapshot(c.class); err == nil {
+		previous, _ = current.(*cache.Snapshot)
+	}
+	stages, err := orderedSnapshots(previous, ss)
+	if err != nil {
+		return err
+	}
+	if err := c.SnapshotCache.SetSnapshot(ctx, c.class, snapshot); err != nil || len(stages) == 0 {
+		// without changes the streams keep following the stages they are at
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stages = stages
+	for key, st := range c.streams {
+		st.index = 0
+		c.push(key, st)
+	}
+	return nil
+}
+
+// push the stage to the stream, and the stages after it that the stream already has
+func (c *classCache) push(key streamKey, st *adsStage) {
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	for len(c.stages) > 0 {
+		stage := c.stages[st.index]
+		if err := c.SnapshotCache.SetSnapshot(c.ctx, st.node.Id, stage.snapshot); err != nil {
+			zap.L().Error("Error in setting the SnapShot", zap.Error(err))
+			return
+		}
+		if st.index == len(c.stages)-1 {
+			return
+		}
+		if !c.ads.acked(key, stage.typeURL, stage.snapshot.GetVersion(stage.typeURL)) {
+			index := st.index
+			st.timer = time.AfterFunc(adsAckTimeout, func() { c.expire(key, st, index) })
+			return
+		}
+		st.index++
+	}
+}
+
+// advance the stream to the next stage once it acknowledged the current one
+func (c *classCache) advance(key streamKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, has := c.streams[key]
+	if !has || st.index >= len(c.stages)-1 {
+		return
+	}
+	stage := c.stages[st.index]
+	if c.ads.acked(key, stage.typeURL, stage.snapshot.GetVersion(stage.typeURL)) {
+		st.index++
+		c.push(key, st)
+	}
+}
+
+// expire pushes the next stage to a stream that did not acknowledge the stage in time
+func (c *classCache) expire(key streamKey, st *adsStage, index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.streams[key] != st || st.index != index {
+		return
+	}
+	zap.L().Warn("Timeout waiting for ADS client to acknowledge", zap.String("class", c.class), zap.String("type", c.stages[index].typeURL))
+	st.index++
+	c.push(key, st)
+}
+
+// stream of the ADS stream, created on its first watch. A new stream gets the last stage, it has nothing to order.
+func (c *classCache) stream(key streamKey) *adsStage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, has := c.streams[key]; has {
+		return st
+	}
+	if c.streams == nil {
+		c.streams = make(map[streamKey]*adsStage)
+	}
+	st := &adsStage{node: &core.Node{Id: fmt.Sprintf("%s/stream=%d,delta=%t", c.class, key.id, key.delta)}}
+	c.streams[key] = st
+	if len(c.stages) > 0 {
+		st.index = len(c.stages) - 1
+		c.push(key, st)
+	}
+	c.ads.follow(key, func() { c.advance(key) })
+	return st
+}
+
+// closeStream drops the snapshot of a closed stream
+func (c *classCache) closeStream(key streamKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, has := c.streams[key]; has {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		c.SnapshotCache.ClearSnapshot(st.node.Id)
+		delete(c.streams, key)
+	}
+}
+
+func (c *classCache) CreateWatch(req *cache.Request, ss stream.StreamState, resp chan cache.Response) func() {
+	return c.SnapshotCache.CreateWatch(withNode(req, &core.Node{Id: c.class}), ss, resp)
+}
+
+func (c *classCache) CreateDeltaWatch(req *cache.DeltaRequest, ss stream.StreamState, resp chan cache.DeltaResponse) func() {
+	return c.SnapshotCache.CreateDeltaWatch(withDeltaNode(req, &core.Node{Id: c.class}), ss, resp)
+}
+
+func (c *classCache) Fetch(ctx context.Context, req *cache.Request) (cache.Response, error) {
+	return c.SnapshotCache.Fetch(ctx, withNode(req, &core.Node{Id: c.class}))
+}
+
+// adsWatcher watches the snapshot of an ADS stream
+type adsWatcher struct {
+	c    *classCache
+	node *core.Node
+}
+
+func (w adsWatcher) CreateWatch(req *cache.Request, ss stream.StreamState, resp chan cache.Response) func() {
+	return w.c.SnapshotCache.CreateWatch(withNode(req, w.node), ss, resp)
+}
+
+func (w adsWatcher) CreateDeltaWatch(req *cache.DeltaRequest, ss stream.StreamState, resp chan cache.DeltaResponse) func() {
+	return w.c.SnapshotCache.CreateDeltaWatch(withDeltaNode(req, w.node), ss, resp)
+}
+
+// watcher of the ADS stream
+func (c *classCache) watcher(key streamKey) cache.ConfigWatcher {
+	return adsWatcher{c: c, node: c.stream(key).node}
+}
+
+// withNode copies the request for the node, the snapshot cache keys its watches by the node
+func withNode(req *cache.Request, node *core.Node) *cache.Request {
+	return &cache.Request{
+		VersionInfo:   req.VersionInfo,
+		Node:          node,
+		ResourceNames: req.ResourceNames,
+		TypeUrl:       req.TypeUrl,
+		ResponseNonce: req.ResponseNonce,
+		ErrorDetail:   req.ErrorDetail,
+	}
+}
+
+func withDeltaNode(req *cache.DeltaRequest, node *core.Node) *cache.DeltaRequest {
+	return &cache.DeltaRequest{
+		Node:                     node,
+		TypeUrl:                  req.TypeUrl,
+		ResourceNamesSubscribe:   req.ResourceNamesSubscribe,
+		ResourceNamesUnsubscribe: req.ResourceNamesUnsubscribe,
+		InitialResourceVersions:  req.InitialResourceVersions,
+		ResponseNonce:            req.ResponseNonce,
+		ErrorDetail:              req.ErrorDetail,
+	}
+}
+
+// adsStreams tracks the pushes to ADS streams and their acknowledgements, so the next stage is only pushed to a stream
+// once it has the previous one
+type adsStreams struct {
+	sync.Mutex
+	streams map[streamKey]*adsStream
+}
+
+type adsStream struct {
+	types map[string]*adsPush
+	// acked is called when the stream acknowledges a push
+	acked func()
+}
+
+// adsPush is the state of a resource type on a stream
+type adsPush struct {
+	nonce   string
+	version string
+	pending bool
+	acked   string
+}
+
+func (a *adsStreams) init() {
+	if a.streams == nil {
+		a.streams = make(map[streamKey]*adsStream)
+	}
+}
+
+func (a *adsStreams) open(key streamKey) {
+	a.Lock()
+	defer a.Unlock()
+	a.init()
+	a.streams[key] = &adsStream{types: map[string]*adsPush{}}
+}
+
+func (a *adsStreams) close(key streamKey) {
+	a.Lock()
+	defer a.Unlock()
+	a.init()
+	delete(a.streams, key)
+}
+
+// follow calls fn whenever the stream acknowledges a push
+func (a *adsStreams) follow(key streamKey, fn func()) {
+	a.Lock()
+	defer a.Unlock()
+	if s, has := a.streams[key]; has {
+		s.acked = fn
+	}
+}
+
+// has tells if the stream is an ADS stream
+func (a *adsStreams) has(key streamKey) bool {
+	a.Lock()
+	defer a.Unlock()
+	_, has := a.streams[key]
+	return has
+}
+
+// request records the acknowledgement (or rejection) of the last push
+func (a *adsStreams) request(key streamKey, typeURL string, nonce string) {
+	a.Lock()
+	a.init()
+	s, has := a.streams[key]
+	if !has {
+		a.Unlock()
+		return
+	}
+	push, has := s.types[typeURL]
+	if !has {
+		push = &adsPush{}
+		s.types[typeURL] = push
+	}
+	var acked func()
+	if push.pending && nonce == push.nonce {
+		push.pending = false
+		push.acked = push.version
+		acked = s.acked
+	}
+	a.Unlock()
+	if acked != nil {
+		acked()
+	}
+}
+
+func (a *adsStreams) response(key streamKey, typeURL string, nonce string, version string) {
+	a.Lock()
+	defer a.Unlock()
+	a.init()
+	s, has := a.streams[key]
+	if !has {
+		return
+	}
+	push := &adsPush{nonce: nonce, version: version, pending: true}
+	if previous, has := s.types[typeURL]; has {
+		push.acked = previous.acked
+	}
+	s.types[typeURL] = push
+}
+
+// acked tells if the stream has the version of the type: it acknowledged the version, or did not subscribe to the type
+func (a *adsStreams) acked(key streamKey, typeURL string, version string) bool {
+	a.Lock()
+	defer a.Unlock()
+	s, open := a.streams[key]
+	if !open {
+		return true
+	}
+	push, subscribed := s.types[typeURL]
+	// delta xDS only pushes changed resources, so there might be nothing to acknowledge
+	return !subscribed || push.acked == version || (key.delta && !push.pending)
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestOrderedSnapshots(t *testing.T) {
+	node := &core.Node{Id: "envoy", UserAgentName: "envoy"}
+	previous, err := GenerateSnapshot(node, Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}}, Options{})
+	assert.NoError(t, err)
+	next, err := GenerateSnapshot(node, Mapping{"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8081, Zone: "europe-west4-a"}}}}, Options{})
+	assert.NoError(t, err)
+
+	stages, err := orderedSnapshots(previous, next)
+	assert.NoError(t, err)
+	order := []resource.Type{}
+	for _, stage := range stages {
+		order = append(order, stage.typeURL)
+	}
+	assert.Equal(t, []resource.Type{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType, resource.ClusterType, resource.EndpointType}, order)
+	assert.Equal(t, []string{"a-cluster", "b-cluster"}, resourceNames(stages[0].snapshot.GetResources(resource.ClusterType)))
+	assert.Equal(t, []string{"outbound_8081"}, resourceNames(stages[2].snapshot.GetResources(resource.ListenerType)))
+	assert.Equal(t, []string{"a-cluster", "b-cluster"}, resourceNames(stages[3].snapshot.GetResources(resource.ClusterType)))
+	for _, typ := range []resource.Type{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType} {
+		assert.Equal(t, next.GetVersion(typ), stages[len(stages)-1].snapshot.GetVersion(typ))
+	}
+
+	stages, err = orderedSnapshots(nil, next)
+	assert.NoError(t, err)
+	assert.Len(t, stages, 1)
+}
+
+func TestClassCacheStages(t *testing.T) {
+	node := &core.Node{Id: "envoy", UserAgentName: "envoy"}
+	previous, err := GenerateSnapshot(node, Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}}, Options{})
+	assert.NoError(t, err)
+	next, err := GenerateSnapshot(node, Mapping{"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8081, Zone: "europe-west4-a"}}}}, Options{})
+	assert.NoError(t, err)
+
+	ads := &adsStreams{}
+	c := &classCache{SnapshotCache: cache.NewSnapshotCache(false, idHash{}, nil), ctx: context.TODO(), class: "class", ads: ads}
+	slow, fast := streamKey{id: 1}, streamKey{id: 2}
+	for _, key := range []streamKey{slow, fast} {
+		ads.open(key)
+		for _, typ := range []string{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType} {
+			ads.request(key, typ, "")
+		}
+		c.stream(key)
+	}
+	assert.NoError(t, c.SetSnapshot(context.TODO(), "class", previous))
+	assert.NoError(t, c.SetSnapshot(context.TODO(), "class", next))
+	snapshot := func(key streamKey) interface{} {
+		ss, err := c.GetSnapshot(c.streams[key].node.Id)
+		assert.NoError(t, err)
+		return ss
+	}
+	// the stages are computed once, the streams share them
+	assert.Len(t, c.stages, 6)
+	assert.Same(t, c.stages[0].snapshot, snapshot(slow))
+	assert.Same(t, c.stages[0].snapshot, snapshot(fast))
+
+	// the stream that acknowledges the clusters gets the next stage, up to the first type it did not acknowledge yet
+	ads.response(fast, resource.ClusterType, "1", c.stages[0].snapshot.GetVersion(resource.ClusterType))
+	ads.request(fast, resource.ClusterType, "1")
+	assert.Same(t, c.stages[1].snapshot, snapshot(fast))
+	assert.Same(t, c.stages[0].snapshot, snapshot(slow))
+
+	// closed streams drop their snapshot
+	c.closeStream(fast)
+	_, err = c.GetSnapshot("class/stream=2,delta=false")
+	assert.Error(t, err)
+}
+
+// adsTestStream is an ADS stream of a test client
+type adsTestStream struct {
+	t         *testing.T
+	stream    discoverygrpc.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	responses chan *discoverygrpc.DiscoveryResponse
+	names     map[string][]string
+}
+
+// openAdsStream subscribes the node to the names of all types
+func openAdsStream(ctx context.Context, t *testing.T, conn *grpc.ClientConn, node *core.Node, names map[string][]string) *adsTestStream {
+	stream, err := discoverygrpc.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx, grpc.WaitForReady(true))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	s := &adsTestStream{t: t, stream: stream, responses: make(chan *discoverygrpc.DiscoveryResponse, 10), names: names}
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			s.responses <- resp
+		}
+	}()
+	for _, typ := range []string{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType} {
+		assert.NoError(t, stream.Send(&discoverygrpc.DiscoveryRequest{Node: node, TypeUrl: typ, ResourceNames: names[typ]}))
+	}
+	return s
+}
+
+func (s *adsTestStream) recv(timeout time.Duration) *discoverygrpc.DiscoveryResponse {
+	select {
+	case resp := <-s.responses:
+		return resp
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func (s *adsTestStream) ack(resp *discoverygrpc.DiscoveryResponse) {
+	assert.NoError(s.t, s.stream.Send(&discoverygrpc.DiscoveryRequest{TypeUrl: resp.TypeUrl, ResourceNames: s.names[resp.TypeUrl], VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce}))
+}
+
+var adsTestNames = map[string][]string{
+	resource.ClusterType:  nil,
+	resource.EndpointType: {"a-cluster", "b-cluster"},
+	resource.ListenerType: nil,
+	resource.RouteType:    {"outbound_8080", "outbound_8081"},
+}
+
+func TestXdsAdsOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9050)
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}})
+
+	conn, err := grpc.DialContext(ctx, "localhost:9050", grpc.WithInsecure())
+	if !assert.NoError(t, err) {
+		return
+	}
+	node := &core.Node{Id: "envoy", UserAgentName: "envoy", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	stream := openAdsStream(ctx, t, conn, node, adsTestNames)
+	if stream == nil {
+		return
+	}
+	for i := 0; i < 4; i++ {
+		resp := stream.recv(5 * time.Second)
+		if !assert.NotNil(t, resp) {
+			return
+		}
+		stream.ack(resp)
+	}
+
+	// a new service is pushed cluster first, and the next type only after the client acknowledged the previous one
+	discovery.Emit(Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8081, Zone: "europe-west4-a"}}},
+	})
+	for _, typ := range []string{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType} {
+		resp := stream.recv(5 * time.Second)
+		if !assert.NotNil(t, resp) {
+			return
+		}
+		assert.Equal(t, typ, resp.TypeUrl)
+		assert.Nil(t, stream.recv(200*time.Millisecond))
+		stream.ack(resp)
+	}
+}
+
+// TestXdsAdsStuckClient does not hold back the changes of the other clients of the class until a stuck client acknowledges
+func TestXdsAdsStuckClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9170)
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}})
+
+	conn, err := grpc.DialContext(ctx, "localhost:9170", grpc.WithInsecure())
+	if !assert.NoError(t, err) {
+		return
+	}
+	node := &core.Node{Id: "envoy", UserAgentName: "envoy", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	stuck := openAdsStream(ctx, t, conn, node, adsTestNames)
+	healthy := openAdsStream(ctx, t, conn, node, adsTestNames)
+	if stuck == nil || healthy == nil {
+		return
+	}
+	// the stuck client acknowledges the first snapshot, but not the changes
+	for i := 0; i < 4; i++ {
+		if resp := stuck.recv(5 * time.Second); assert.NotNil(t, resp) {
+			stuck.ack(resp)
+		}
+		resp := healthy.recv(5 * time.Second)
+		if !assert.NotNil(t, resp) {
+			return
+		}
+		healthy.ack(resp)
+	}
+
+	discovery.Emit(Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8081, Zone: "europe-west4-a"}}},
+	})
+	// well within the acknowledgement timeout of the stuck client
+	deadline := time.Now().Add(adsAckTimeout / 2)
+	for _, typ := range []string{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType} {
+		resp := healthy.recv(time.Until(deadline))
+		if !assert.NotNil(t, resp, typ) {
+			return
+		}
+		assert.Equal(t, typ, resp.TypeUrl)
+		healthy.ack(resp)
+	}
+	// the stuck client only got the first stage
+	resp := stuck.recv(time.Second)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, resource.ClusterType, resp.TypeUrl)
+	}
+	assert.Nil(t, stuck.recv(200*time.Millisecond))
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Annotations of a Service that configure its affinity, like `k8s-xds/affinity: header:x-user-id`
+const (
+	affinityAnnotation       = "k8s-xds/affinity"
+	affinityPolicyAnnotation = "k8s-xds/affinity-policy"
+)
+
+// Hash policies of the clusters with affinity
+const (
+	affinityPolicyRingHash = "ringHash"
+	// affinityPolicyMaglev is only supported by Envoy, gRPC (1.46) clients get a ring hash instead
+	affinityPolicyMaglev = "maglev"
+)
+
+// channelIDKey is the filter state by which gRPC hashes the calls of a channel (gRPC A42)
+const channelIDKey = "io.grpc.channel_id"
+
+// AffinityConfig sends the calls with the same hash key to the same endpoint, e.g. for services with per-user caches
+type AffinityConfig struct {
+	// Header whose value is hashed, like x-user-id. Without a header the calls of a client (gRPC channel, or the source
+	// IP for Envoy) stick to an endpoint, like Kubernetes' sessionAffinity: ClientIP.
+	Header string `mapstructure:"header"`
+	// Policy is "ringHash" (default) or "maglev"
+	Policy string `mapstructure:"policy"`
+	// MinimumRingSize of the ring hash, defaults to 1024 entries
+	MinimumRingSize uint64 `mapstructure:"minimumRingSize"`
+}
+
+func (a *AffinityConfig) validate() error {
+	if a == nil {
+		return nil
+	}
+	switch a.Policy {
+	case "", affinityPolicyRingHash, affinityPolicyMaglev:
+		return nil
+	default:
+		return fmt.Errorf("unknown affinity policy %q", a.Policy)
+	}
+}
+
+// affinityFromService reads the affinity of a Service from its annotations, or from its sessionAffinity
+func affinityFromService(annotations map[string]string, clientIP bool) *AffinityConfig {
+	value, annotated := annotations[affinityAnnotation]
+	if !annotated && !clientIP {
+		return nil
+	}
+	affinity := &AffinityConfig{Policy: annotations[affinityPolicyAnnotation]}
+	if header := strings.TrimPrefix(value, "header:"); header != value {
+		affinity.Header = header
+	}
+	if affinity.validate() != nil {
+		affinity.Policy = ""
+	}
+	return affinity
+}
+
+// serviceAffinity is the configured affinity of the service, or that of its Service
+func serviceAffinity(zones map[string][]podEndPoint, cfg ServiceConfig) *AffinityConfig {
+	if cfg.Affinity != nil {
+		return cfg.Affinity
+	}
+	for _, endpoints := range zones {
+		for _, e := range endpoints {
+			if e.Affinity != nil {
+				return e.Affinity
+			}
+		}
+	}
+	return nil
+}
+
+// useAffinity hashes the calls of the cluster to its endpoints
+func useAffinity(c *cluster.Cluster, a *AffinityConfig, envoy bool) {
+	if a == nil {
+		return
+	}
+	// the load_balancing_policy would take precedence over the lb_policy
+	c.LoadBalancingPolicy = nil
+	if a.Policy == affinityPolicyMaglev && envoy {
+		c.LbPolicy = cluster.Cluster_MAGLEV
+		return
+	}
+	c.LbPolicy = cluster.Cluster_RING_HASH
+	// gRPC (1.46) only supports the xxHash function, which is the default
+	if a.MinimumRingSize > 0 {
+		c.LbConfig = &cluster.Cluster_RingHashLbConfig_{RingHashLbConfig: &cluster.Cluster_RingHashLbConfig{
+			MinimumRingSize: wrapperspb.UInt64(a.MinimumRingSize),
+		}}
+	} else {
+		c.LbConfig = nil
+	}
+}
+
+// hashPolicies are the hash policies of the routes of a service with affinity
+func hashPolicies(a *AffinityConfig, envoy bool) []*route.RouteAction_HashPolicy {
+	if a == nil {
+		return nil
+	}
+	if a.Header != "" {
+		return []*route.RouteAction_HashPolicy{{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{Header: &route.RouteAction_HashPolicy_Header{HeaderName: a.Header}},
+		}}
+	}
+	if envoy {
+		return []*route.RouteAction_HashPolicy{{
+			PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true}},
+		}}
+	}
+	return []*route.RouteAction_HashPolicy{{
+		PolicySpecifier: &route.RouteAction_HashPolicy_FilterState_{FilterState: &route.RouteAction_HashPolicy_FilterState{Key: channelIDKey}},
+	}}
+}
+
+// useHashPolicies sets the hash policies on the routes of the virtual host
+func useHashPolicies(vh *route.VirtualHost, policies []*route.RouteAction_HashPolicy) {
+	if len(policies) == 0 {
+		return
+	}
+	for _, r := range vh.Routes {
+		if action := r.GetRoute(); action != nil {
+			action.HashPolicy = policies
+		}
+	}
+}
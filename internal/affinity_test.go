@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	examplev1 "github.com/hermanbanken/k8s-xds/example/pkg/gen/v1"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/xds"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAffinityFromService(t *testing.T) {
+	assert.Nil(t, affinityFromService(nil, false))
+	assert.Equal(t, &AffinityConfig{}, affinityFromService(nil, true))
+	assert.Equal(t, &AffinityConfig{Header: "x-user-id", Policy: "maglev"},
+		affinityFromService(map[string]string{affinityAnnotation: "header:x-user-id", affinityPolicyAnnotation: "maglev"}, false))
+	// unknown policies fall back to the ring hash
+	assert.Equal(t, &AffinityConfig{}, affinityFromService(map[string]string{affinityAnnotation: "channel", affinityPolicyAnnotation: "random"}, false))
+
+	var info ServiceInfo
+	info.FromV1(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "search", Annotations: map[string]string{affinityAnnotation: "header:x-user-id"}},
+		Spec:       corev1.ServiceSpec{ClusterIP: "None"},
+	})
+	assert.Equal(t, &AffinityConfig{Header: "x-user-id"}, info.Affinity)
+
+	// the endpoints of the Service carry its affinity
+	d := &DiscoveryImpl{}
+	slices := map[string]Slice{"search-abc": {
+		Name: "search-abc", Namespace: "default", Service: "search",
+		Endpoints: []Endpoint{{Addresses: []string{"10.0.0.1"}, Topology: Topology{Zone: "europe-west4-a"}}},
+		Ports:     []Port{{Port: 8080}},
+	}}
+	mapping := d.computeMapping(slices, map[string]ServiceInfo{"search": info})
+	assert.Equal(t, info.Affinity, mapping["search"]["europe-west4-a"][0].Affinity)
+	assert.Error(t, ServiceConfig{Affinity: &AffinityConfig{Policy: "random"}}.validate())
+}
+
+func TestGenerateSnapshotAffinity(t *testing.T) {
+	affinity := &AffinityConfig{Policy: affinityPolicyMaglev}
+	mapping := Mapping{
+		"search": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a", Affinity: affinity}}},
+		"users":  {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}},
+	}
+	// the configured affinity takes precedence over that of the Service
+	opts := Options{Services: Services{"users": {Affinity: &AffinityConfig{Header: "x-user-id", MinimumRingSize: 64}}}}
+	ss, err := GenerateSnapshot(&core.Node{Id: "client"}, mapping, opts)
+	assert.NoError(t, err)
+	search := ss.GetResources(resource.ClusterType)["search-cluster"].(*cluster.Cluster)
+	assert.Equal(t, cluster.Cluster_RING_HASH, search.LbPolicy)
+	assert.Nil(t, search.LoadBalancingPolicy)
+	users := ss.GetResources(resource.ClusterType)["users-cluster"].(*cluster.Cluster)
+	assert.Equal(t, uint64(64), users.GetRingHashLbConfig().GetMinimumRingSize().GetValue())
+	hash := ss.GetResources(resource.RouteType)["search-route"].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute().HashPolicy
+	assert.Equal(t, channelIDKey, hash[0].GetFilterState().GetKey())
+	hash = ss.GetResources(resource.RouteType)["users-route"].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute().HashPolicy
+	assert.Equal(t, "x-user-id", hash[0].GetHeader().GetHeaderName())
+
+	// Envoy supports maglev, and hashes the source IP instead of the channel
+	ss, err = GenerateSnapshot(&core.Node{Id: "envoy", UserAgentName: "envoy"}, mapping, opts)
+	assert.NoError(t, err)
+	search = ss.GetResources(resource.ClusterType)["search-cluster"].(*cluster.Cluster)
+	assert.Equal(t, cluster.Cluster_MAGLEV, search.LbPolicy)
+	assert.NoError(t, search.ValidateAll())
+	rc := ss.GetResources(resource.RouteType)["outbound_8080"].(*route.RouteConfiguration)
+	assert.NoError(t, rc.ValidateAll())
+	for _, vh := range rc.VirtualHosts {
+		hash := vh.Routes[0].GetRoute().HashPolicy
+		if vh.Name == "search-vhost" {
+			assert.True(t, hash[0].GetConnectionProperties().GetSourceIp())
+		} else {
+			assert.Equal(t, "x-user-id", hash[0].GetHeader().GetHeaderName())
+		}
+	}
+}
+
+// TestXdsAffinity sends the calls of a user to the same endpoint
+func TestXdsAffinity(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	go runServer(8150)
+	go runServer(8151)
+	go runServer(8152)
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9150)
+	config.Set("services", map[string]interface{}{"search": map[string]interface{}{"affinity": map[string]interface{}{"header": "x-user-id"}}})
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"search": {"europe-west4-a": {
+		{IP: "127.0.0.1", Port: 8150, Zone: "europe-west4-a"},
+		{IP: "127.0.0.1", Port: 8151, Zone: "europe-west4-a"},
+		{IP: "127.0.0.1", Port: 8152, Zone: "europe-west4-a"},
+	}}})
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting([]byte(`{
+  "xds_servers": [{"server_uri": "localhost:9150", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "node": {"id": "affinity-client", "locality": {"zone": "europe-west4-a"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := grpc.DialContext(ctx, "xds:///search", grpc.WithInsecure(), grpc.WithResolvers(resolver))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+
+	call := func(user string) string {
+		resp, err := examplev1.NewExampleClient(c).DoSomething(metadata.AppendToOutgoingContext(ctx, "x-user-id", user), &examplev1.ExampleRequest{Name: user}, grpc.WaitForReady(true))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		return resp.Message
+	}
+	backends := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		first := call(user)
+		for j := 0; j < 5; j++ {
+			assert.Equal(t, first, call(user), user)
+		}
+		backends[first[len(first)-4:]] = true
+	}
+	assert.Greater(t, len(backends), 1, "the users are spread over the endpoints")
+}
@@ -3,8 +3,12 @@ package internal
 import (
 	"context"
 	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 
 	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 
 	"go.uber.org/zap"
@@ -14,42 +18,63 @@ import (
 func (cb *Callbacks) Report() {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
-	zap.L().Debug("cb.Report()  callbacks", zap.Any("Fetches", cb.Fetches), zap.Any("Requests", cb.Requests))
+	zap.L().Debug("cb.Report()  callbacks", zap.Any("Fetches", cb.Fetches), zap.Any("Requests", cb.Requests), zap.Any("DeltaRequests", cb.DeltaRequests))
 }
 
 // OnStreamOpen type
 func (cb *Callbacks) OnStreamOpen(ctx context.Context, id int64, typ string) error {
 	zap.L().Debug("OnStreamOpen", zap.Int64("id", id), zap.String("type", typ))
+	if typ == resource.AnyType {
+		cb.ads.open(streamKey{id: id})
+	}
 	return nil
 }
 
 // OnStreamClosed type
 func (cb *Callbacks) OnStreamClosed(id int64) {
 	zap.L().Debug("OnStreamClosed", zap.Int64("id", id))
+	cb.closed(streamKey{id: id})
 }
 
 // OnDeltaStreamOpen is called once an incremental xDS stream is open with a stream ID and the type URL (or "" for ADS).
 // Returning an error will end processing and close the stream. OnStreamClosed will still be called.
 func (cb *Callbacks) OnDeltaStreamOpen(ctx context.Context, id int64, typ string) error {
-	zap.L().Debug("", zap.Int64("id", id), zap.String("type", typ))
+	zap.L().Debug("OnDeltaStreamOpen", zap.Int64("id", id), zap.String("type", typ))
+	if typ == resource.AnyType {
+		cb.ads.open(streamKey{id: id, delta: true})
+	}
 	return nil
 }
 
 // OnDeltaStreamClosed is called immediately prior to closing an xDS stream with a stream ID.
 func (cb *Callbacks) OnDeltaStreamClosed(id int64) {
-	zap.L().Debug("", zap.Int64("id", id))
+	zap.L().Debug("OnDeltaStreamClosed", zap.Int64("id", id))
+	cb.closed(streamKey{id: id, delta: true})
 }
 
 // OnStreamDeltaRequest is called once a request is received on a stream.
 // Returning an error will end processing and close the stream. OnStreamClosed will still be called.
 func (cb *Callbacks) OnStreamDeltaRequest(id int64, req *discoveryv3.DeltaDiscoveryRequest) error {
-	zap.L().Debug("", zap.Int64("id", id))
+	zap.L().Debug("OnStreamDeltaRequest", zap.Int64("id", id), zap.Any("Request", req))
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.DeltaRequests++
+	key := streamKey{id: id, delta: true}
+	cb.opened(key, req, req.Node)
+	cb.ads.request(key, req.TypeUrl, req.ResponseNonce)
+	if cb.Signal != nil {
+		close(cb.Signal)
+		cb.Signal = nil
+	}
 	return nil
 }
 
-// OnStreamDelatResponse is called immediately prior to sending a response on a stream.
+// OnStreamDeltaResponse is called immediately prior to sending a response on a stream.
 func (cb *Callbacks) OnStreamDeltaResponse(id int64, req *discoveryv3.DeltaDiscoveryRequest, resp *discoveryv3.DeltaDiscoveryResponse) {
-	zap.L().Debug("", zap.Int64("id", id))
+	zap.L().Debug("OnStreamDeltaResponse", zap.Int64("id", id), zap.String("type", resp.TypeUrl),
+		zap.Int("resources", len(resp.Resources)), zap.Strings("removed", resp.RemovedResources))
+	cb.ads.response(streamKey{id: id, delta: true}, resp.TypeUrl, resp.Nonce, resp.SystemVersionInfo)
+	cb.Report()
 }
 
 // OnStreamRequest type
@@ -58,6 +83,9 @@ func (cb *Callbacks) OnStreamRequest(id int64, req *discoveryv3.DiscoveryRequest
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.Requests++
+	key := streamKey{id: id}
+	cb.opened(key, req, req.Node)
+	cb.ads.request(key, req.TypeUrl, req.ResponseNonce)
 	if cb.Signal != nil {
 		close(cb.Signal)
 		cb.Signal = nil
@@ -68,6 +96,7 @@ func (cb *Callbacks) OnStreamRequest(id int64, req *discoveryv3.DiscoveryRequest
 // OnStreamResponse type
 func (cb *Callbacks) OnStreamResponse(ctx context.Context, id int64, req *discoveryv3.DiscoveryRequest, resp *discoveryv3.DiscoveryResponse) {
 	zap.L().Debug("OnStreamResponse", zap.Int64("id", id), zap.Any("Request", req), zap.Any("Response ", resp))
+	cb.ads.response(streamKey{id: id}, resp.TypeUrl, resp.Nonce, resp.VersionInfo)
 	cb.Report()
 }
 
@@ -77,6 +106,10 @@ func (cb *Callbacks) OnFetchRequest(ctx context.Context, req *discoveryv3.Discov
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.Fetches++
+	if req.Node != nil {
+		// fetches have no stream, so the node is released unless it opens one
+		cb.idle(nodeKey(req.Node), req.Node)
+	}
 	if cb.Signal != nil {
 		close(cb.Signal)
 		cb.Signal = nil
@@ -89,12 +122,130 @@ func (cb *Callbacks) OnFetchResponse(req *discoveryv3.DiscoveryRequest, resp *di
 	zap.L().Debug("OnFetchResponse", zap.Any("Request", req), zap.Any("Response", resp))
 }
 
+// opened tracks the node of a stream, the node is only sent in the first request of a stream. It also tracks the
+// request, so the cache can tell the stream of the watch it creates for the request.
+func (cb *Callbacks) opened(id streamKey, req interface{}, node *core.Node) {
+	if cb.requests == nil {
+		cb.requests = make(map[interface{}]streamKey)
+		cb.lastRequests = make(map[streamKey]interface{})
+	}
+	delete(cb.requests, cb.lastRequests[id])
+	cb.requests[req] = id
+	cb.lastRequests[id] = req
+	if node == nil {
+		return
+	}
+	if _, tracked := cb.streams[id]; tracked {
+		return
+	}
+	key := nodeKey(node)
+	n := cb.node(key, node)
+	cb.streams[id] = key
+	n.open++
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+}
+
+// streamOf is the stream of a request, and whether it is an ADS stream; requests that are not tracked, like fetches,
+// have no stream
+func (cb *Callbacks) streamOf(req interface{}) (streamKey, bool) {
+	cb.mu.Lock()
+	id, tracked := cb.requests[req]
+	cb.mu.Unlock()
+	if !tracked {
+		return streamKey{}, false
+	}
+	return id, cb.ads.has(id)
+}
+
+func (cb *Callbacks) closed(id streamKey) {
+	cb.ads.close(id)
+	if cb.Closed != nil {
+		cb.Closed(id)
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	delete(cb.requests, cb.lastRequests[id])
+	delete(cb.lastRequests, id)
+	key, tracked := cb.streams[id]
+	if !tracked {
+		return
+	}
+	delete(cb.streams, id)
+	cb.nodes[key].open--
+	if cb.nodes[key].open == 0 {
+		cb.idle(key, cb.nodes[key].node)
+	}
+}
+
+// idle releases the node after the grace period, unless it opens a stream in the meantime
+func (cb *Callbacks) idle(key string, node *core.Node) {
+	n := cb.node(key, node)
+	if cb.Release == nil {
+		delete(cb.nodes, key)
+		return
+	}
+	if n.open > 0 || n.timer != nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(cb.GracePeriod, func() {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		if cb.nodes[key] != n || n.timer != timer {
+			return
+		}
+		delete(cb.nodes, key)
+		zap.L().Debug("Node has no streams", zap.String("Id", node.Id), zap.Duration("gracePeriod", cb.GracePeriod))
+		cb.Release(node)
+	})
+	n.timer = timer
+}
+
+func (cb *Callbacks) node(key string, node *core.Node) *nodeStreams {
+	if cb.nodes == nil {
+		cb.streams = make(map[streamKey]string)
+		cb.nodes = make(map[string]*nodeStreams)
+	}
+	n, has := cb.nodes[key]
+	if !has {
+		n = &nodeStreams{node: node}
+		cb.nodes[key] = n
+	}
+	return n
+}
+
 // Callbacks for XD Server
 type Callbacks struct {
-	Signal   chan struct{}
-	Fetches  int
-	Requests int
-	mu       sync.Mutex
+	Signal        chan struct{}
+	Fetches       int
+	Requests      int
+	DeltaRequests int
+	// Release is called for nodes that have had no open streams for the GracePeriod
+	Release func(node *core.Node)
+	// Closed is called for every closed stream
+	Closed       func(id streamKey)
+	GracePeriod  time.Duration
+	streams      map[streamKey]string
+	requests     map[interface{}]streamKey
+	lastRequests map[streamKey]interface{}
+	nodes        map[string]*nodeStreams
+	ads          adsStreams
+	mu           sync.Mutex
+}
+
+// streamKey identifies a stream, the state of the world and the delta server number their streams independently
+type streamKey struct {
+	id    int64
+	delta bool
+}
+
+type nodeStreams struct {
+	node  *core.Node
+	open  int
+	timer *time.Timer
 }
 
 var _ xds.Callbacks = &Callbacks{}
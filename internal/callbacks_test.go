@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseNodesWithoutStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	d := &DiscoveryImpl{}
+	stopped := make(chan string, 10)
+	fc := &FilterCache{
+		ctx: ctx,
+		createFn: func(ctx context.Context, node *core.Node, _ *Subscriptions) cache.SnapshotCache {
+			stream := d.Watch(ctx)
+			go func() {
+				for {
+					select {
+					case <-stream:
+					case <-ctx.Done():
+						stopped <- node.Id
+						return
+					}
+				}
+			}()
+			return cache.NewSnapshotCache(false, cache.IDHash{}, nil)
+		},
+	}
+	cb := &Callbacks{GracePeriod: 50 * time.Millisecond, Release: fc.Release}
+
+	a := &core.Node{Id: "a", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	b := &core.Node{Id: "b", Locality: &core.Locality{Zone: "europe-west4-b"}}
+	assert.NoError(t, cb.OnStreamRequest(1, &discoveryv3.DiscoveryRequest{Node: a}))
+	assert.NoError(t, cb.OnStreamRequest(2, &discoveryv3.DiscoveryRequest{Node: b}))
+	assert.NoError(t, cb.OnStreamRequest(3, &discoveryv3.DiscoveryRequest{Node: b}))
+	fc.get(a)
+	fc.get(b)
+	assert.Equal(t, 2, fc.Len())
+	d.Emit(Mapping{})
+
+	// b still has a stream open
+	cb.OnStreamClosed(1)
+	cb.OnStreamClosed(2)
+	assert.Equal(t, "a", waitStopped(t, stopped))
+	assert.Equal(t, 1, fc.Len())
+	assert.Eventually(t, func() bool {
+		d.Lock()
+		defer d.Unlock()
+		return len(d.workers) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// reconnecting within the grace period keeps the cache
+	cb.OnStreamClosed(3)
+	assert.NoError(t, cb.OnStreamDeltaRequest(4, &discoveryv3.DeltaDiscoveryRequest{Node: b}))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, fc.Len())
+
+	cb.OnDeltaStreamClosed(4)
+	assert.Equal(t, "b", waitStopped(t, stopped))
+	assert.Equal(t, 0, fc.Len())
+	d.Emit(Mapping{})
+}
+
+func waitStopped(t *testing.T, stopped chan string) string {
+	select {
+	case id := <-stopped:
+		return id
+	case <-time.After(time.Second):
+		t.Fatal("node was not released")
+		return ""
+	}
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// subsetBuckets is the number of distinct endpoint subsets handed out per zone. Nodes in the same bucket get the same
+// subset, so they can share their snapshots.
+const subsetBuckets = 16
+
+// nodeClass holds all properties of a node that the generated resources depend on. Snapshots are generated once per
+// class and shared by all of its nodes, instead of being generated for every node.
+// Other node metadata than the SERVICE key (serviceMetadataKey) is ignored, the policies do not read it. A policy that
+// starts to read node metadata has to add it to the class, or nodes with different metadata would share its snapshots.
+type nodeClass struct {
+	Zone   string
+	Subset int64
+	Envoy  bool
+	// Service is the service served by the node, if any
+	Service string
+}
+
+func classOf(node *core.Node) nodeClass {
+	// Using maximum number of endpoints requires randomness to avoid subsetting the possible large amount of endpoints
+	// This requires a seed that is stable per node, so we hash the node id. The hash is reduced to one of the
+	// subsetBuckets, so nodes share subsets (and snapshots) instead of each getting a subset of its own.
+	h := fnv.New64a()
+	h.Write([]byte(node.GetId()))
+	return nodeClass{
+		Zone:    node.GetLocality().GetZone(),
+		Subset:  int64(h.Sum64() % subsetBuckets),
+		Envoy:   isEnvoy(node),
+		Service: nodeService(node),
+	}
+}
+
+func (c nodeClass) String() string {
+	return fmt.Sprintf("zone=%s,subset=%d,envoy=%t,service=%s", c.Zone, c.Subset, c.Envoy, c.Service)
+}
+
+// nodeKey identifies the class of the node, nodes of a class share their cache
+func nodeKey(node *core.Node) string {
+	return classOf(node).String()
+}
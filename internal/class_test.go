@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var benchmarkZones = []string{"europe-west4-a", "europe-west4-b", "europe-west4-c"}
+
+func TestNodeClasses(t *testing.T) {
+	nodes := benchmarkNodes(5000)
+	classes := map[nodeClass][]*core.Node{}
+	for _, node := range nodes {
+		classes[classOf(node)] = append(classes[classOf(node)], node)
+	}
+	assert.Len(t, classes, len(benchmarkZones)*subsetBuckets)
+
+	mapping := benchmarkMapping(30, 30)
+	for class, nodes := range classes {
+		ss, err := GenerateSnapshot(nodes[0], mapping, Options{})
+		assert.NoError(t, err)
+		shared, err := generateSnapshot(class, mapping, Options{})
+		assert.NoError(t, err)
+		assert.Equal(t, ss.GetVersion(resource.EndpointType), shared.GetVersion(resource.EndpointType))
+	}
+
+	// policy relevant metadata is part of the class
+	server, _ := structpb.NewStruct(map[string]interface{}{serviceMetadataKey: "example-server"})
+	assert.NotEqual(t, nodeKey(nodes[0]), nodeKey(&core.Node{Id: nodes[0].Id, Locality: nodes[0].Locality, Metadata: server}))
+	assert.NotEqual(t, nodeKey(nodes[0]), nodeKey(&core.Node{Id: nodes[0].Id, Locality: nodes[0].Locality, UserAgentName: "envoy"}))
+	// other metadata is ignored
+	other, _ := structpb.NewStruct(map[string]interface{}{"SOME_KEY": "SOME_VALUE"})
+	assert.Equal(t, nodeKey(nodes[0]), nodeKey(&core.Node{Id: nodes[0].Id, Locality: nodes[0].Locality, Metadata: other}))
+}
+
+// BenchmarkGenerateSnapshots compares generating the snapshots of 5k nodes per node and per class, for 10k endpoints
+func BenchmarkGenerateSnapshots(b *testing.B) {
+	mapping := benchmarkMapping(100, 100)
+	nodes := benchmarkNodes(5000)
+
+	b.Run("PerNode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			snapshots := 0
+			for _, node := range nodes {
+				if _, err := GenerateSnapshot(node, mapping, Options{}); err != nil {
+					b.Fatal(err)
+				}
+				snapshots++
+			}
+			b.ReportMetric(float64(snapshots), "snapshots/op")
+		}
+	})
+
+	b.Run("PerClass", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			classes := map[nodeClass]bool{}
+			for _, node := range nodes {
+				class := classOf(node)
+				if classes[class] {
+					continue
+				}
+				if _, err := generateSnapshot(class, mapping, Options{}); err != nil {
+					b.Fatal(err)
+				}
+				classes[class] = true
+			}
+			b.ReportMetric(float64(len(classes)), "snapshots/op")
+		}
+	})
+}
+
+func benchmarkMapping(services int, endpointsPerService int) Mapping {
+	mapping := Mapping{}
+	for s := 0; s < services; s++ {
+		zones := map[string][]podEndPoint{}
+		for e := 0; e < endpointsPerService; e++ {
+			zone := benchmarkZones[e%len(benchmarkZones)]
+			zones[zone] = append(zones[zone], podEndPoint{IP: fmt.Sprintf("10.%d.%d.%d", s, e/256, e%256), Port: 8080, Zone: zone, Namespace: "default"})
+		}
+		mapping[fmt.Sprintf("service-%d", s)] = zones
+	}
+	return mapping
+}
+
+func benchmarkNodes(n int) []*core.Node {
+	nodes := make([]*core.Node, n)
+	for i := range nodes {
+		nodes[i] = &core.Node{Id: fmt.Sprintf("pod-%d", i), Locality: &core.Locality{Zone: benchmarkZones[i%len(benchmarkZones)]}}
+	}
+	return nodes
+}
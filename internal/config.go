@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// ServiceConfig holds the settings of one upstream service, read from the `services` config key
+type ServiceConfig struct {
+	// Port the (xDS enabled) gRPC servers of the service listen on, defaults to the discovered endpoint ports
+	Port uint32 `mapstructure:"port"`
+	// Protocol of the service: "http" (default, includes gRPC) or "tcp", which Envoy proxies as is
+	Protocol string `mapstructure:"protocol"`
+	// Authorization lists the RBAC policies of the servers of the service; when empty all calls are allowed
+	Authorization []AuthorizationPolicy `mapstructure:"authorization"`
+	// ServiceAccounts (namespace/name) of the servers, defaults to the ServiceAccounts of the discovered pods
+	ServiceAccounts []string `mapstructure:"serviceAccounts"`
+	// Plaintext opts the service out of mutual TLS
+	Plaintext bool `mapstructure:"plaintext"`
+	// CircuitBreaker limits the concurrent calls of each client
+	CircuitBreaker *CircuitBreakerConfig `mapstructure:"circuitBreaker"`
+	// OutlierDetection makes clients eject failing hosts locally
+	OutlierDetection *OutlierDetectionConfig `mapstructure:"outlierDetection"`
+	// WeightedRoundRobin weighs the endpoints by the load they report with ORCA, instead of plain round robin
+	WeightedRoundRobin *WeightedRoundRobinConfig `mapstructure:"weightedRoundRobin"`
+	// RouteLookup routes the calls by a request header, to the services of the header values
+	RouteLookup *RouteLookupConfig `mapstructure:"routeLookup"`
+	// Failover lists the services that take the calls, in order, when the service has no healthy endpoints
+	Failover []string `mapstructure:"failover"`
+	// Endpoints is the endpoint mode: "pods" (default) balances over the Pod IPs, "clusterIP" sends the calls to the
+	// ClusterIP of the Service. ExternalName services are resolved by the clients (logical DNS).
+	Endpoints string `mapstructure:"endpoints"`
+	// Host is an external DNS name, resolved by the clients, that serves the service on Port instead of discovered endpoints
+	Host string `mapstructure:"host"`
+	// GrpcServices are the full names of the gRPC services of the service, like example.v1.Example, which the health
+	// checks probe and of which the methods in the descriptors get their own routes
+	GrpcServices []string `mapstructure:"grpcServices"`
+	// SlowStart ramps up the traffic to new endpoints
+	SlowStart *SlowStartConfig `mapstructure:"slowStart"`
+	// Affinity hashes the calls to the endpoints, instead of the annotations or sessionAffinity of the Service
+	Affinity *AffinityConfig `mapstructure:"affinity"`
+	// Methods are the policies of the methods, on top of those from the descriptors
+	Methods []MethodConfig `mapstructure:"methods"`
+}
+
+// Services maps service names to their configuration
+type Services map[string]ServiceConfig
+
+// ReadServices reads the per-service configuration
+func ReadServices(config *viper.Viper) (Services, error) {
+	services := Services{}
+	if err := config.UnmarshalKey("services", &services); err != nil {
+		return services, err
+	}
+	for name, cfg := range services {
+		if err := cfg.validate(); err != nil {
+			return services, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	return services, nil
+}
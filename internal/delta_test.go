@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// TestXdsDelta subscribes like an Envoy with `api_type: DELTA_GRPC` (example/envoy/envoy-delta.yaml) would. gRPC-Go 1.46
+// has no delta xDS client, so the test speaks the delta ADS protocol itself.
+func TestXdsDelta(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9030)
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}, "europe-west4-b": {{IP: "10.0.1.2", Port: 8080, Zone: "europe-west4-b"}}},
+	})
+
+	conn, err := grpc.DialContext(ctx, "localhost:9030", grpc.WithInsecure())
+	if !assert.NoError(t, err) {
+		return
+	}
+	stream, err := discoverygrpc.NewAggregatedDiscoveryServiceClient(conn).DeltaAggregatedResources(ctx, grpc.WaitForReady(true))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, stream.Send(&discoverygrpc.DeltaDiscoveryRequest{
+		Node:                   &core.Node{Id: "delta", Locality: &core.Locality{Zone: "europe-west4-a"}},
+		TypeUrl:                resource.EndpointType,
+		ResourceNamesSubscribe: []string{"a-cluster", "b-cluster"},
+	}))
+	resp := recvDelta(t, stream)
+	assert.ElementsMatch(t, []string{"a-cluster", "b-cluster"}, deltaResourceNames(resp))
+
+	// only the changed assignment is sent
+	assert.NoError(t, stream.Send(&discoverygrpc.DeltaDiscoveryRequest{TypeUrl: resource.EndpointType, ResponseNonce: resp.Nonce}))
+	discovery.Emit(Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}, {IP: "10.0.0.3", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-b": {{IP: "10.0.1.2", Port: 8080, Zone: "europe-west4-b"}}, "europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}},
+	})
+	resp = recvDelta(t, stream)
+	assert.Equal(t, []string{"a-cluster"}, deltaResourceNames(resp))
+	cla := &endpoint.ClusterLoadAssignment{}
+	assert.NoError(t, resp.Resources[0].Resource.UnmarshalTo(cla))
+	assert.Len(t, cla.Endpoints[0].LbEndpoints, 2)
+
+	// removed services are removed from the client
+	assert.NoError(t, stream.Send(&discoverygrpc.DeltaDiscoveryRequest{TypeUrl: resource.EndpointType, ResponseNonce: resp.Nonce}))
+	discovery.Emit(Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}, {IP: "10.0.0.3", Port: 8080, Zone: "europe-west4-a"}}},
+	})
+	resp = recvDelta(t, stream)
+	assert.Empty(t, resp.Resources)
+	assert.Equal(t, []string{"b-cluster"}, resp.RemovedResources)
+}
+
+func recvDelta(t *testing.T, stream discoverygrpc.AggregatedDiscoveryService_DeltaAggregatedResourcesClient) *discoverygrpc.DeltaDiscoveryResponse {
+	type result struct {
+		resp *discoverygrpc.DeltaDiscoveryResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := stream.Recv()
+		ch <- result{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delta response")
+		return nil
+	}
+}
+
+func deltaResourceNames(resp *discoverygrpc.DeltaDiscoveryResponse) (names []string) {
+	for _, r := range resp.Resources {
+		names = append(names, r.Name)
+	}
+	return names
+}
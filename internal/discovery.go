@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"expvar"
 	"io/ioutil"
 	"os"
 	"sync"
@@ -15,41 +16,98 @@ import (
 
 type Discovery interface {
 	Start(ctx context.Context, upstreamServices []string) error
-	Watch() <-chan Mapping
+	// Watch streams the mappings until ctx is done
+	Watch(ctx context.Context) <-chan Mapping
 }
 
-// DiscoveryImpl is a generic discovery layer that hooks to Fn.
+// Fan-out metrics, served by the admin server at /debug/vars
+var (
+	mappingsEmitted = expvar.NewInt("discovery_mappings_emitted")
+	// mappingsCoalesced counts the mappings replaced by a newer one before a watcher read them
+	mappingsCoalesced = expvar.NewInt("discovery_mappings_coalesced")
+	// mappingsDropped counts the mappings not sent to watchers that stopped
+	mappingsDropped = expvar.NewInt("discovery_mappings_dropped")
+)
+
+// DiscoveryImpl is a generic discovery layer that hooks to Fn, and to ServiceFn if set.
 // It generates and emits zoned mappings, by inspecting the Slice's Endpoint information.
 type DiscoveryImpl struct {
 	sync.Mutex
 	last    Mapping
-	workers []func(Mapping)
+	workers map[int]func(Mapping)
+	nextID  int
 	Fn      func(context.Context, func(t watch.EventType, s Slice)) error
+	// ServiceFn watches the Services, for the endpoint modes that use their ClusterIP or ExternalName
+	ServiceFn func(context.Context, func(t watch.EventType, s ServiceInfo)) error
+	// DrainPeriod keeps removed (and terminating) endpoints as draining for this period, zero removes them immediately
+	DrainPeriod time.Duration
+
+	// live and draining endpoints of the last computed mapping, see drain
+	live     map[endpointKey]podEndPoint
+	draining map[endpointKey]drainingEndpoint
 }
 
 func (d *DiscoveryImpl) Start(ctx context.Context, upstreamServices []string) error {
+	// the watches run concurrently, as does the debounced computation
+	var mu sync.Mutex
 	slices := make(map[string]Slice)
+	services := make(map[string]ServiceInfo)
 	debounced := debounce.New(50 * time.Millisecond)
+	var changed func()
+	changed = func() {
+		debounced(func() {
+			mu.Lock()
+			m := d.computeMapping(slices, services)
+			now := time.Now()
+			next := d.drain(m, now)
+			mu.Unlock()
+			d.Emit(m)
+			// remove the drained endpoints once their period passed
+			if !next.IsZero() {
+				time.AfterFunc(next.Sub(now), changed)
+			}
+		})
+	}
+	if d.ServiceFn != nil {
+		go func() {
+			err := d.ServiceFn(ctx, func(t watch.EventType, s ServiceInfo) {
+				if len(upstreamServices) > 0 && !Contains(upstreamServices, s.Name) {
+					return
+				}
+				mu.Lock()
+				if t == watch.Added || t == watch.Modified {
+					services[s.Name] = s
+				} else if t == watch.Deleted {
+					delete(services, s.Name)
+				}
+				mu.Unlock()
+				changed()
+			})
+			if err != nil && ctx.Err() == nil {
+				zap.L().Error("service watch stopped", zap.Error(err))
+			}
+		}()
+	}
 	return d.Fn(ctx, func(t watch.EventType, s Slice) {
 		if len(upstreamServices) > 0 && !Contains(upstreamServices, s.Service) {
 			zap.L().Debug("skip watch event", zap.String("service", s.Service))
 			return
 		}
 		zap.L().Debug("watch event", zap.String("service", s.Service))
+		mu.Lock()
 		if t == watch.Added || t == watch.Modified {
 			slices[s.Name] = s
 		} else if t == watch.Deleted {
 			delete(slices, s.Name)
 		}
-		debounced(func() {
-			m := d.computeMapping(slices)
-			d.Emit(m)
-		})
+		mu.Unlock()
+		changed()
 	})
 }
 
-// computeMapping converts from EndpointSlices to a zoned mapping so the downstream services do not need to transform individually
-func (d *DiscoveryImpl) computeMapping(slices map[string]Slice) Mapping {
+// computeMapping converts from EndpointSlices to a zoned mapping so the downstream services do not need to transform individually.
+// The ClusterIPs and ExternalNames of the Services are added as endpoints too, see applyEndpointModes.
+func (d *DiscoveryImpl) computeMapping(slices map[string]Slice, services map[string]ServiceInfo) Mapping {
 	mapping := Mapping{}
 	for _, slice := range slices {
 		var service map[string][]podEndPoint
@@ -59,43 +117,106 @@ func (d *DiscoveryImpl) computeMapping(slices map[string]Slice) Mapping {
 			mapping[slice.Service] = service
 		}
 		for _, e := range slice.Endpoints {
+			// terminating endpoints drain, if enabled
+			if e.Terminating && d.DrainPeriod > 0 {
+				continue
+			}
 			for _, address := range e.Addresses {
 				for _, port := range slice.Ports {
 					service[e.Topology.Zone] = append(service[e.Topology.Zone], podEndPoint{
-						IP:   address,
-						Port: port.Port,
-						Zone: e.Topology.Zone,
+						IP:             address,
+						Port:           port.Port,
+						Zone:           e.Topology.Zone,
+						Namespace:      slice.Namespace,
+						ServiceAccount: e.ServiceAccount,
+						FirstSeen:      e.ReadySince,
 					})
 				}
 			}
 		}
 	}
+	for _, info := range services {
+		if info.Affinity != nil {
+			for _, endpoints := range mapping[info.Name] {
+				for i := range endpoints {
+					endpoints[i].Affinity = info.Affinity
+				}
+			}
+		}
+		if info.ExternalName == "" && info.ClusterIP == "" {
+			continue
+		}
+		service, hasService := mapping[info.Name]
+		if !hasService {
+			service = map[string][]podEndPoint{}
+			mapping[info.Name] = service
+		}
+		ports := info.Ports
+		if len(ports) == 0 && info.ExternalName != "" {
+			// ExternalName services need no ports, the port is configured then
+			ports = []Port{{}}
+		}
+		for _, port := range ports {
+			e := podEndPoint{Port: port.Port, Namespace: info.Namespace, Affinity: info.Affinity}
+			if info.ExternalName != "" {
+				e.Hostname = info.ExternalName
+			} else {
+				e.IP, e.ClusterIP = info.ClusterIP, true
+			}
+			service[""] = append(service[""], e)
+		}
+	}
 	return mapping
 }
 
 // Watch always emits the last computed value first, so the consumer can start immediately
-func (d *DiscoveryImpl) Watch() <-chan Mapping {
+func (d *DiscoveryImpl) Watch(ctx context.Context) <-chan Mapping {
 	d.Lock()
 	defer d.Unlock()
 
-	var size = 0
-	if d.last != nil {
-		size = 1
-	}
-	ch := make(chan Mapping, size)
+	// a single slot holding the latest mapping: slow consumers skip intermediate mappings instead of blocking Emit
+	ch := make(chan Mapping, 1)
 	if d.last != nil {
 		ch <- d.last
 	}
-	d.workers = append(d.workers, func(m Mapping) {
+	if d.workers == nil {
+		d.workers = make(map[int]func(Mapping))
+	}
+	id := d.nextID
+	d.nextID++
+	d.workers[id] = func(m Mapping) {
+		if ctx.Err() != nil {
+			mappingsDropped.Add(1)
+			return
+		}
+		select {
+		case ch <- m:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+			mappingsCoalesced.Add(1)
+		default:
+		}
+		// Emit is the only sender and holds the lock, so the slot is free
 		ch <- m
-	})
+	}
+	go func() {
+		<-ctx.Done()
+		d.Lock()
+		defer d.Unlock()
+		delete(d.workers, id)
+	}()
 	return ch
 }
 
+// Emit sends the mapping to all watchers without blocking
 func (d *DiscoveryImpl) Emit(m Mapping) {
 	d.Lock()
 	defer d.Unlock()
 	d.last = m
+	mappingsEmitted.Add(1)
 	for _, w := range d.workers {
 		w(m)
 	}
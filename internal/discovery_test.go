@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmitDoesNotBlockOnSlowWatchers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	d := &DiscoveryImpl{}
+	slow := d.Watch(ctx)
+	stoppedCtx, stop := context.WithCancel(ctx)
+	d.Watch(stoppedCtx)
+	stop()
+
+	coalesced := mappingsCoalesced.Value()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			d.Emit(Mapping{fmt.Sprintf("service-%d", i): nil})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Emit blocked")
+	}
+
+	// the slow watcher continues with the latest mapping
+	assert.Equal(t, Mapping{"service-99": nil}, <-slow)
+	assert.Equal(t, int64(99), mappingsCoalesced.Value()-coalesced)
+	select {
+	case m := <-slow:
+		t.Fatalf("unexpected mapping %v", m)
+	default:
+	}
+
+	// new watchers start with the latest mapping
+	assert.Equal(t, Mapping{"service-99": nil}, <-d.Watch(ctx))
+}
+
+// manualDiscovery discovers nothing itself, the tests emit the mappings
+type manualDiscovery struct {
+	DiscoveryImpl
+}
+
+func (d *manualDiscovery) Start(ctx context.Context, upstreamServices []string) error {
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"time"
+)
+
+// endpointKey identifies an endpoint of a service across mappings
+type endpointKey struct {
+	service string
+	ip      string
+	port    int32
+}
+
+// drainingEndpoint is an endpoint that left the discovered endpoints, which is kept until its deadline
+type drainingEndpoint struct {
+	podEndPoint
+	service string
+	until   time.Time
+}
+
+// drain keeps the endpoints that left the mapping, or are terminating, for the DrainPeriod: they are marked as draining,
+// so clients send no new calls to them while the calls in flight finish. It returns when the next endpoint is removed.
+// It is called with the computed mappings in order, by Start.
+func (d *DiscoveryImpl) drain(mapping Mapping, now time.Time) (next time.Time) {
+	if d.DrainPeriod <= 0 {
+		return time.Time{}
+	}
+	if d.draining == nil {
+		d.draining = make(map[endpointKey]drainingEndpoint)
+	}
+	live := make(map[endpointKey]podEndPoint)
+	for service, zones := range mapping {
+		for _, endpoints := range zones {
+			for _, e := range endpoints {
+				if !e.Draining && !e.ClusterIP && e.Hostname == "" {
+					live[endpointKey{service, e.IP, e.Port}] = e
+				}
+			}
+		}
+	}
+	for key, e := range d.live {
+		if _, has := live[key]; !has {
+			if _, has := d.draining[key]; !has {
+				d.draining[key] = drainingEndpoint{podEndPoint: e, service: key.service, until: now.Add(d.DrainPeriod)}
+			}
+		}
+	}
+	d.live = live
+	for key, e := range d.draining {
+		if _, back := live[key]; back || !now.Before(e.until) {
+			delete(d.draining, key)
+			continue
+		}
+		zones, has := mapping[e.service]
+		if !has {
+			zones = map[string][]podEndPoint{}
+			mapping[e.service] = zones
+		}
+		e.podEndPoint.Draining = true
+		zones[e.Zone] = append(zones[e.Zone], e.podEndPoint)
+		if next.IsZero() || e.until.Before(next) {
+			next = e.until
+		}
+	}
+	return next
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestDrain(t *testing.T) {
+	d := &DiscoveryImpl{DrainPeriod: time.Minute}
+	now := time.Now()
+	a := podEndPoint{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}
+	b := podEndPoint{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}
+	assert.True(t, d.drain(Mapping{"a": {"europe-west4-a": {a, b}}}, now).IsZero())
+
+	// the removed endpoint drains
+	m := Mapping{"a": {"europe-west4-a": {a}}}
+	assert.Equal(t, now.Add(time.Minute), d.drain(m, now))
+	drainingB := b
+	drainingB.Draining = true
+	assert.Equal(t, Mapping{"a": {"europe-west4-a": {a, drainingB}}}, m)
+
+	// also when the service is gone
+	m = Mapping{}
+	assert.Equal(t, now.Add(time.Minute), d.drain(m, now.Add(time.Second)))
+	drainingA := a
+	drainingA.Draining = true
+	assert.ElementsMatch(t, []podEndPoint{drainingA, drainingB}, m["a"]["europe-west4-a"])
+
+	// until the period passed, or it comes back
+	m = Mapping{"a": {"europe-west4-a": {a}}}
+	assert.True(t, d.drain(m, now.Add(time.Minute)).IsZero())
+	assert.Equal(t, Mapping{"a": {"europe-west4-a": {a}}}, m)
+}
+
+func TestDrainTerminating(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	slice := Slice{Name: "a-abc", Service: "a", Ports: []Port{{Port: 8080}}, Endpoints: []Endpoint{
+		{Addresses: []string{"10.0.0.1"}, Topology: Topology{Zone: "europe-west4-a"}},
+		{Addresses: []string{"10.0.0.2"}, Topology: Topology{Zone: "europe-west4-a"}},
+	}}
+	events := make(chan Slice)
+	d := &DiscoveryImpl{DrainPeriod: 200 * time.Millisecond, Fn: func(ctx context.Context, fn func(watch.EventType, Slice)) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case s := <-events:
+				fn(watch.Modified, s)
+			}
+		}
+	}}
+	mappings := d.Watch(ctx)
+	go d.Start(ctx, nil)
+	events <- slice
+	assert.Len(t, (<-mappings)["a"]["europe-west4-a"], 2)
+
+	// the terminating endpoint drains, then it is removed
+	terminating := slice
+	terminating.Endpoints = []Endpoint{slice.Endpoints[0], slice.Endpoints[1]}
+	terminating.Endpoints[1].Terminating = true
+	events <- terminating
+	assert.Equal(t, []podEndPoint{
+		{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"},
+		{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a", Draining: true},
+	}, (<-mappings)["a"]["europe-west4-a"])
+	assert.Equal(t, []podEndPoint{{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}, (<-mappings)["a"]["europe-west4-a"])
+}
+
+func TestClusterLoadAssignmentDraining(t *testing.T) {
+	zones := map[string][]podEndPoint{"europe-west4-a": {
+		{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"},
+		{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a", Draining: true},
+	}}
+	cla := clusterLoadAssignment(zones, "a-cluster", "europe-west4-a", 0, nil, nil)[0].(*endpoint.ClusterLoadAssignment)
+	statuses := map[string]core.HealthStatus{}
+	for _, e := range cla.Endpoints[0].LbEndpoints {
+		statuses[e.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = e.HealthStatus
+	}
+	assert.Equal(t, map[string]core.HealthStatus{"10.0.0.1": core.HealthStatus_HEALTHY, "10.0.0.2": core.HealthStatus_DRAINING}, statuses)
+}
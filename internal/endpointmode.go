@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+)
+
+// Endpoint modes of a service
+const (
+	// endpointModePods sends the calls to the Pod IPs of the EndpointSlices, balanced by the clients (default)
+	endpointModePods = "pods"
+	// endpointModeClusterIP sends the calls to the ClusterIP of the Service, balanced by kube-proxy, e.g. for services
+	// behind a NetworkPolicy that only allows traffic through kube-proxy
+	endpointModeClusterIP = "clusterIP"
+)
+
+// validate the endpoint mode, affinity and methods of the service
+func (cfg ServiceConfig) validate() error {
+	switch cfg.Endpoints {
+	case "", endpointModePods, endpointModeClusterIP:
+	default:
+		return fmt.Errorf("unknown endpoint mode %q", cfg.Endpoints)
+	}
+	if cfg.Host != "" && cfg.Port == 0 {
+		return fmt.Errorf("host %s requires a port", cfg.Host)
+	}
+	for _, m := range cfg.Methods {
+		if !strings.Contains(strings.TrimPrefix(m.Name, "/"), "/") {
+			return fmt.Errorf("method %q is not like package.Service/Method", m.Name)
+		}
+	}
+	return cfg.Affinity.validate()
+}
+
+// applyEndpointModes picks the endpoints of each service by its mode. ExternalName services and services configured with
+// a Host are resolved by the clients (logical DNS) instead. The mapping is shared by all nodes, so it is copied on change.
+func applyEndpointModes(mapping Mapping, services Services) Mapping {
+	result := mapping
+	copied := false
+	set := func(service string, zones map[string][]podEndPoint) {
+		if !copied {
+			result = make(Mapping, len(mapping))
+			for s, z := range mapping {
+				result[s] = z
+			}
+			copied = true
+		}
+		if zones == nil {
+			delete(result, service)
+		} else {
+			result[service] = zones
+		}
+	}
+	for service, zones := range mapping {
+		if filtered, changed := endpointsOfMode(zones, services[service]); changed {
+			set(service, filtered)
+		}
+	}
+	for service, cfg := range services {
+		if cfg.Host != "" {
+			set(service, map[string][]podEndPoint{"": {{Hostname: cfg.Host, Port: int32(cfg.Port)}}})
+		}
+	}
+	return result
+}
+
+// endpointsOfMode filters the endpoints of a service by its mode. It returns nil when none remain, like for a service in
+// the clusterIP mode of which the Service is not discovered yet, so the service is not served without endpoints.
+func endpointsOfMode(zones map[string][]podEndPoint, cfg ServiceConfig) (map[string][]podEndPoint, bool) {
+	var hasClusterIP, hasHostname bool
+	for _, endpoints := range zones {
+		for _, e := range endpoints {
+			hasClusterIP = hasClusterIP || e.ClusterIP
+			hasHostname = hasHostname || e.Hostname != ""
+		}
+	}
+	var keep func(e podEndPoint) bool
+	switch {
+	case hasHostname:
+		keep = func(e podEndPoint) bool { return e.Hostname != "" }
+	case cfg.Endpoints == endpointModeClusterIP:
+		keep = func(e podEndPoint) bool { return e.ClusterIP }
+	case hasClusterIP:
+		keep = func(e podEndPoint) bool { return !e.ClusterIP }
+	default:
+		return zones, false
+	}
+	filtered := map[string][]podEndPoint{}
+	for zone, endpoints := range zones {
+		for _, e := range endpoints {
+			if !keep(e) {
+				continue
+			}
+			// ExternalName services without ports use the configured port
+			if e.Hostname != "" && e.Port == 0 {
+				e.Port = int32(cfg.Port)
+			}
+			filtered[zone] = append(filtered[zone], e)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, true
+	}
+	return filtered, true
+}
+
+// dnsEndpoint is the endpoint of a service that the clients resolve themselves, with the lowest port
+func dnsEndpoint(zones map[string][]podEndPoint) (podEndPoint, bool) {
+	var found podEndPoint
+	for _, endpoints := range zones {
+		for _, e := range endpoints {
+			if e.Hostname != "" && (found.Hostname == "" || e.Port < found.Port) {
+				found = e
+			}
+		}
+	}
+	return found, found.Hostname != ""
+}
+
+// logicalDNSCluster makes the clients resolve the host of the endpoint, and connect to its addresses
+func logicalDNSCluster(c *cluster.Cluster, e podEndPoint) {
+	c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: cluster.Cluster_LOGICAL_DNS}
+	c.EdsClusterConfig = nil
+	// gRPC requires a single locality with a single endpoint
+	c.LoadAssignment = &endpoint.ClusterLoadAssignment{
+		ClusterName: c.Name,
+		Endpoints: []*endpoint.LocalityLbEndpoints{{
+			LbEndpoints: []*endpoint.LbEndpoint{{
+				HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{Address: &core.Address_SocketAddress{SocketAddress: &core.SocketAddress{
+						Address:       e.Hostname,
+						Protocol:      core.SocketAddress_TCP,
+						PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(e.Port)},
+					}}},
+				}},
+			}},
+		}},
+	}
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/xds"
+)
+
+func TestComputeMappingServices(t *testing.T) {
+	d := &DiscoveryImpl{}
+	slices := map[string]Slice{"search-abc": {
+		Name: "search-abc", Namespace: "default", Service: "search",
+		Endpoints: []Endpoint{{Addresses: []string{"10.0.0.1"}, Topology: Topology{Zone: "europe-west4-a"}}},
+		Ports:     []Port{{Port: 8080}},
+	}}
+	services := map[string]ServiceInfo{
+		"search":   {Name: "search", Namespace: "default", ClusterIP: "10.96.0.10", Ports: []Port{{Port: 80}}},
+		"payments": {Name: "payments", Namespace: "default", ExternalName: "api.payments.example.com"},
+		"headless": {Name: "headless", Namespace: "default"},
+	}
+	assert.Equal(t, Mapping{
+		"search": {
+			"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a", Namespace: "default"}},
+			"":               {{IP: "10.96.0.10", Port: 80, Namespace: "default", ClusterIP: true}},
+		},
+		"payments": {"": {{Hostname: "api.payments.example.com", Namespace: "default"}}},
+	}, d.computeMapping(slices, services))
+}
+
+func TestApplyEndpointModes(t *testing.T) {
+	pods := map[string][]podEndPoint{"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}
+	clusterIP := map[string][]podEndPoint{"": {{IP: "10.96.0.10", Port: 80, ClusterIP: true}}}
+	both := map[string][]podEndPoint{"europe-west4-a": pods["europe-west4-a"], "": clusterIP[""]}
+	mapping := Mapping{
+		"search":   both,
+		"pinned":   both,
+		"pending":  pods,
+		"payments": {"": {{Hostname: "api.payments.example.com"}}},
+	}
+	services := Services{
+		"pinned":   {Endpoints: endpointModeClusterIP},
+		"pending":  {Endpoints: endpointModeClusterIP},
+		"payments": {Port: 443},
+		"maps":     {Host: "maps.example.com", Port: 443},
+	}
+	assert.Equal(t, Mapping{
+		"search":   pods,
+		"pinned":   clusterIP,
+		"payments": {"": {{Hostname: "api.payments.example.com", Port: 443}}},
+		"maps":     {"": {{Hostname: "maps.example.com", Port: 443}}},
+	}, applyEndpointModes(mapping, services))
+	// the shared mapping is left as is
+	assert.Len(t, mapping, 4)
+
+	assert.Error(t, ServiceConfig{Endpoints: "nodes"}.validate())
+	assert.Error(t, ServiceConfig{Host: "maps.example.com"}.validate())
+}
+
+func TestGenerateSnapshotLogicalDNS(t *testing.T) {
+	mapping := Mapping{"payments": {"": {{Hostname: "api.payments.example.com", Port: 443}}}}
+	for _, node := range []*core.Node{{Id: "client"}, {Id: "envoy", UserAgentName: "envoy"}} {
+		ss, err := GenerateSnapshot(node, mapping, Options{})
+		assert.NoError(t, err)
+		assert.NoError(t, ss.Consistent())
+		assert.Empty(t, ss.GetResources(resource.EndpointType))
+		c := ss.GetResources(resource.ClusterType)["payments-cluster"].(*cluster.Cluster)
+		assert.Equal(t, cluster.Cluster_LOGICAL_DNS, c.GetType())
+		assert.Nil(t, c.EdsClusterConfig)
+		assert.NoError(t, c.ValidateAll())
+		address := c.LoadAssignment.Endpoints[0].LbEndpoints[0].HostIdentifier.(*endpoint.LbEndpoint_Endpoint).Endpoint.Address.GetSocketAddress()
+		assert.Equal(t, "api.payments.example.com", address.Address)
+		assert.Equal(t, uint32(443), address.GetPortValue())
+	}
+}
+
+// TestXdsLogicalDNS dials an ExternalName service and an external host, which the client resolves itself
+func TestXdsLogicalDNS(t *testing.T) {
+	if rerunWithEnv(t, aggregateClusterEnv) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	go runServer(8130)
+	go runServer(8131)
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9130)
+	config.Set("services", map[string]interface{}{"maps": map[string]interface{}{"host": "localhost", "port": 8131}})
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"payments": {"": {{Hostname: "localhost", Port: 8130, Namespace: "default"}}}})
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting([]byte(`{
+  "xds_servers": [{"server_uri": "localhost:9130", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "node": {"id": "dns-client", "locality": {"zone": "europe-west4-a"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for target, port := range map[string]int{"xds:///payments.default": 8130, "xds:///maps": 8131} {
+		c, err := grpc.DialContext(ctx, target, grpc.WithInsecure(), grpc.WithResolvers(resolver))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, fmt.Sprintf("Hi hello world from %d", port), runClient(ctx, c), target)
+		c.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	l "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v3routerpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"go.uber.org/zap"
+)
+
+// defaultClusterDomain is the default DNS suffix of the Kubernetes cluster
+const defaultClusterDomain = "cluster.local"
+
+const protocolTCP = "tcp"
+
+// isEnvoy tells Envoy proxies, which need real listeners, apart from proxyless gRPC clients
+func isEnvoy(node *core.Node) bool {
+	return node.GetUserAgentName() == "envoy"
+}
+
+// serviceAliases are the Kubernetes DNS names of the service
+func serviceAliases(service string, namespace string, clusterDomain string) []string {
+	names := []string{service}
+	if namespace != "" {
+		names = append(names, fmt.Sprintf("%s.%s", service, namespace), fmt.Sprintf("%s.%s.svc.%s", service, namespace, clusterDomain))
+	}
+	return names
+}
+
+// aliasDomains are the aliases, with and without the ports
+func aliasDomains(aliases []string, ports []uint32) []string {
+	domains := []string{}
+	for _, name := range aliases {
+		domains = append(domains, name)
+		for _, port := range ports {
+			domains = append(domains, fmt.Sprintf("%s:%d", name, port))
+		}
+	}
+	return domains
+}
+
+// createEnvoyListeners creates a listener per port. HTTP (and gRPC) services sharing a port are told apart by the domains
+// of their virtual host. TCP services are proxied as is, so a port can only be used by a single TCP service.
+func createEnvoyListeners(mapping Mapping, opts Options, ownZone string) (lds []types.Resource, rds []types.Resource) {
+	services := make([]string, 0, len(mapping))
+	for service := range mapping {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	httpServices := map[uint32][]string{}
+	for _, service := range services {
+		if cfg := opts.Services[service]; cfg.Protocol != protocolTCP {
+			for _, port := range servicePorts(mapping[service], cfg) {
+				httpServices[port] = append(httpServices[port], service)
+			}
+		}
+	}
+	tcpServices := map[uint32]string{}
+	for _, service := range services {
+		if cfg := opts.Services[service]; cfg.Protocol == protocolTCP {
+			for _, port := range servicePorts(mapping[service], cfg) {
+				if _, taken := tcpServices[port]; taken || len(httpServices[port]) > 0 {
+					zap.L().Warn("Port already in use, skipping TCP service", zap.String("service", service), zap.Uint32("port", port))
+					continue
+				}
+				tcpServices[port] = service
+			}
+		}
+	}
+
+	httpPorts := make([]uint32, 0, len(httpServices))
+	for port := range httpServices {
+		httpPorts = append(httpPorts, port)
+	}
+	sort.Slice(httpPorts, func(i, j int) bool { return httpPorts[i] < httpPorts[j] })
+	for _, port := range httpPorts {
+		routeConfigName := fmt.Sprintf("outbound_%d", port)
+		var httpFilters []*hcm.HttpFilter
+		routeConfig := &route.RouteConfiguration{Name: routeConfigName}
+		for _, service := range httpServices[port] {
+			experiment := faultFor(opts.Faults, service, ownZone)
+			if experiment != nil && len(httpFilters) == 0 {
+				httpFilters = append(httpFilters, faultFilter())
+			}
+			domains := aliasDomains(serviceAliases(service, serviceNamespace(mapping[service]), opts.clusterDomain()), []uint32{port})
+			vh := createVirtualHost(fmt.Sprintf("%s-vhost", service), domains, upstreamCluster(resourceNaming{}, service, failoverServices(service, opts.Services[service], mapping)), faultPerFilterConfig(experiment))
+			methods, err := methodRoutes(opts.Services[service], opts.Descriptors)
+			if err != nil {
+				zap.L().Error("Invalid method routes", zap.String("service", service), zap.Error(err))
+			}
+			useMethodRoutes(vh, methods)
+			useHashPolicies(vh, hashPolicies(serviceAffinity(mapping[service], opts.Services[service]), true))
+			routeConfig.VirtualHosts = append(routeConfig.VirtualHosts, vh)
+		}
+		rds = append(rds, routeConfig)
+		lds = append(lds, createEnvoyListener(routeConfigName, port, &l.Filter{
+			Name: wellknown.HTTPConnectionManager,
+			ConfigType: &l.Filter_TypedConfig{
+				TypedConfig: any(&hcm.HttpConnectionManager{
+					CodecType:  hcm.HttpConnectionManager_AUTO,
+					StatPrefix: routeConfigName,
+					RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+						Rds: &hcm.Rds{
+							RouteConfigName: routeConfigName,
+							ConfigSource:    adsConfigSource(),
+						},
+					},
+					HttpFilters: append(httpFilters, &hcm.HttpFilter{
+						Name: "router",
+						ConfigType: &hcm.HttpFilter_TypedConfig{
+							TypedConfig: any(&v3routerpb.Router{}),
+						},
+					}),
+				}),
+			},
+		}))
+	}
+
+	tcpPorts := make([]uint32, 0, len(tcpServices))
+	for port := range tcpServices {
+		tcpPorts = append(tcpPorts, port)
+	}
+	sort.Slice(tcpPorts, func(i, j int) bool { return tcpPorts[i] < tcpPorts[j] })
+	for _, port := range tcpPorts {
+		service := tcpServices[port]
+		lds = append(lds, createEnvoyListener(fmt.Sprintf("outbound_%d", port), port, &l.Filter{
+			Name: wellknown.TCPProxy,
+			ConfigType: &l.Filter_TypedConfig{
+				TypedConfig: any(&tcp.TcpProxy{
+					StatPrefix:       fmt.Sprintf("outbound_%d_%s", port, service),
+					ClusterSpecifier: &tcp.TcpProxy_Cluster{Cluster: upstreamCluster(resourceNaming{}, service, failoverServices(service, opts.Services[service], mapping))},
+				}),
+			},
+		}))
+	}
+	return lds, rds
+}
+
+func createEnvoyListener(listenerName string, port uint32, filter *l.Filter) *l.Listener {
+	zap.L().Debug("Creating ENVOY LISTENER", zap.String("name", listenerName))
+	return &l.Listener{
+		Name: listenerName,
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.SocketAddress_TCP,
+					Address:  "0.0.0.0",
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: port,
+					},
+				},
+			},
+		},
+		FilterChains: []*l.FilterChain{{
+			Filters: []*l.Filter{filter},
+		}},
+	}
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	l "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSnapshotEnvoy(t *testing.T) {
+	mapping := Mapping{
+		"example-server": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a", Namespace: "default"}}},
+		"other-server":   {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a", Namespace: "default"}}},
+		"database":       {"europe-west4-a": {{IP: "10.0.0.3", Port: 5432, Zone: "europe-west4-a", Namespace: "default"}}},
+	}
+	opts := Options{Services: Services{"database": {Protocol: "tcp"}}}
+	node := &core.Node{Id: "envoy", UserAgentName: "envoy", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	ss, err := GenerateSnapshot(node, mapping, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ss.Consistent())
+	for _, typ := range []resource.Type{resource.ListenerType, resource.RouteType, resource.ClusterType, resource.EndpointType} {
+		for name, r := range ss.GetResources(typ) {
+			assert.NoError(t, r.(interface{ ValidateAll() error }).ValidateAll(), name)
+		}
+	}
+
+	listeners := ss.GetResources(resource.ListenerType)
+	assert.Len(t, listeners, 2)
+	http := listeners["outbound_8080"].(*l.Listener)
+	assert.Nil(t, http.ApiListener)
+	assert.Equal(t, uint32(8080), http.Address.GetSocketAddress().GetPortValue())
+	assert.Equal(t, wellknown.HTTPConnectionManager, http.FilterChains[0].Filters[0].Name)
+	assert.Equal(t, wellknown.TCPProxy, listeners["outbound_5432"].(*l.Listener).FilterChains[0].Filters[0].Name)
+
+	rc := ss.GetResources(resource.RouteType)["outbound_8080"].(*route.RouteConfiguration)
+	assert.Len(t, rc.VirtualHosts, 2)
+	assert.Equal(t, "example-server-vhost", rc.VirtualHosts[0].Name)
+	assert.Equal(t, []string{
+		"example-server", "example-server:8080",
+		"example-server.default", "example-server.default:8080",
+		"example-server.default.svc.cluster.local", "example-server.default.svc.cluster.local:8080",
+	}, rc.VirtualHosts[0].Domains)
+
+	// gRPC clients keep getting API listeners
+	ss, err = GenerateSnapshot(&core.Node{Id: "grpc"}, mapping, opts)
+	assert.NoError(t, err)
+	assert.NotNil(t, ss.GetResources(resource.ListenerType)["example-server"].(*l.Listener).ApiListener)
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	aggregate "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/aggregate/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"go.uber.org/zap"
+)
+
+// aggregateClusterType is the cluster type of aggregate clusters (gRPC A37)
+const aggregateClusterType = "envoy.clusters.aggregate"
+
+// failoverServices are the services of the aggregate cluster of a service with a Failover list, in order of preference:
+// the service itself, then the discovered services of the list. It is empty without a Failover list.
+func failoverServices(service string, cfg ServiceConfig, mapping Mapping) []string {
+	if len(cfg.Failover) == 0 {
+		return nil
+	}
+	services := []string{service}
+	for _, fallback := range cfg.Failover {
+		if _, discovered := mapping[fallback]; !discovered || fallback == service {
+			continue
+		}
+		services = append(services, fallback)
+	}
+	return services
+}
+
+// upstreamCluster is the cluster that the calls to the service go to: the aggregate cluster of its failover services, if
+// any, or its own EDS cluster
+func upstreamCluster(naming resourceNaming, service string, failover []string) string {
+	if len(failover) > 0 {
+		return naming.failover(service)
+	}
+	return naming.cluster(service)
+}
+
+// createFailoverCluster creates an aggregate cluster, which sends the calls to the first of the EDS clusters of the
+// services that has healthy endpoints
+func createFailoverCluster(naming resourceNaming, service string, services []string, envoy bool) []types.Resource {
+	zap.L().Debug("Creating FAILOVER CLUSTER", zap.String("name", naming.failover(service)), zap.Strings("services", services))
+	clusters := make([]string, 0, len(services))
+	for _, s := range services {
+		clusters = append(clusters, naming.cluster(s))
+	}
+	// Envoy only allows the aggregate cluster to balance, gRPC (1.46) rejects clusters that do not balance round robin
+	lbPolicy := cluster.Cluster_ROUND_ROBIN
+	if envoy {
+		lbPolicy = cluster.Cluster_CLUSTER_PROVIDED
+	}
+	return []types.Resource{
+		&cluster.Cluster{
+			Name:     naming.failover(service),
+			LbPolicy: lbPolicy,
+			ClusterDiscoveryType: &cluster.Cluster_ClusterType{ClusterType: &cluster.Cluster_CustomClusterType{
+				Name:        aggregateClusterType,
+				TypedConfig: any(&aggregate.ClusterConfig{Clusters: clusters}),
+			}},
+		},
+	}
+}
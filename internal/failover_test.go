@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	aggregate "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/aggregate/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/xds"
+)
+
+// aggregateClusterEnv enables aggregate (and logical DNS) clusters in gRPC (1.46)
+const aggregateClusterEnv = "GRPC_XDS_EXPERIMENTAL_ENABLE_AGGREGATE_AND_LOGICAL_DNS_CLUSTER"
+
+func TestGenerateSnapshotFailover(t *testing.T) {
+	mapping := Mapping{
+		"search":          {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"search-fallback": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}},
+	}
+	// services that are not discovered are left out
+	opts := Options{Services: Services{"search": {Failover: []string{"search-fallback", "search-unknown"}}}}
+	ss, err := GenerateSnapshot(&core.Node{Id: "client"}, mapping, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ss.Consistent())
+	failover := ss.GetResources(resource.ClusterType)["search-failover"].(*cluster.Cluster)
+	assert.Equal(t, aggregateClusterType, failover.GetClusterType().GetName())
+	assert.Equal(t, cluster.Cluster_ROUND_ROBIN, failover.LbPolicy)
+	config := &aggregate.ClusterConfig{}
+	assert.NoError(t, failover.GetClusterType().GetTypedConfig().UnmarshalTo(config))
+	assert.Equal(t, []string{"search-cluster", "search-fallback-cluster"}, config.Clusters)
+	assert.Equal(t, "search-failover", ss.GetResources(resource.RouteType)["search-route"].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute().GetCluster())
+	assert.Equal(t, "search-fallback-cluster", ss.GetResources(resource.RouteType)["search-fallback-route"].(*route.RouteConfiguration).VirtualHosts[0].Routes[0].GetRoute().GetCluster())
+
+	// clients subscribe to the aggregate cluster, then to its clusters
+	assert.Equal(t, "search", subscribedService(resource.ClusterType, "search-failover"))
+	assert.Equal(t, "search", subscribedService(resource.ClusterType, "xdstp://west.k8s-xds/envoy.config.cluster.v3.Cluster/search/failover"))
+	assert.Equal(t, "xdstp://west.k8s-xds/envoy.config.cluster.v3.Cluster/search/failover", resourceNaming{authority: "west.k8s-xds"}.failover("search"))
+
+	// Envoy balances with the aggregate cluster
+	ss, err = GenerateSnapshot(&core.Node{Id: "envoy", UserAgentName: "envoy"}, mapping, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ss.Consistent())
+	failover = ss.GetResources(resource.ClusterType)["search-failover"].(*cluster.Cluster)
+	assert.Equal(t, cluster.Cluster_CLUSTER_PROVIDED, failover.LbPolicy)
+	assert.NoError(t, failover.ValidateAll())
+	rc := ss.GetResources(resource.RouteType)["outbound_8080"].(*route.RouteConfiguration)
+	assert.Equal(t, "search-failover", rc.VirtualHosts[0].Routes[0].GetRoute().GetCluster())
+}
+
+// TestXdsFailover fails over to the fallback service while the service is down
+func TestXdsFailover(t *testing.T) {
+	if rerunWithEnv(t, aggregateClusterEnv) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	// nothing listens on 8120
+	go runServer(8121)
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9120)
+	config.Set("services", map[string]interface{}{"search": map[string]interface{}{"failover": []string{"search-fallback"}}})
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{
+		"search":          {"europe-west4-a": {{IP: "127.0.0.1", Port: 8120, Zone: "europe-west4-a"}}},
+		"search-fallback": {"europe-west4-a": {{IP: "127.0.0.1", Port: 8121, Zone: "europe-west4-a"}}},
+	})
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting([]byte(`{
+  "xds_servers": [{"server_uri": "localhost:9120", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "node": {"id": "failover-client", "locality": {"zone": "europe-west4-a"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := grpc.DialContext(ctx, "xds:///search", grpc.WithInsecure(), grpc.WithResolvers(resolver))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	assert.Equal(t, "Hi hello world from 8121", runClient(ctx, c))
+}
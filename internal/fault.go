@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	commonfault "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/common/fault/v3"
+	fault "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/google/uuid"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// FaultExperiment injects delays and/or UNAVAILABLE aborts into a percentage of the calls to Service.
+// When Zone is set, only callers located in that zone are affected.
+// Every experiment has an expiry time, so it can never be left on by accident.
+type FaultExperiment struct {
+	ID           string        `json:"id" mapstructure:"id"`
+	Service      string        `json:"service" mapstructure:"service"`
+	Zone         string        `json:"zone,omitempty" mapstructure:"zone"`
+	DelayPercent uint32        `json:"delayPercent,omitempty" mapstructure:"delayPercent"`
+	Delay        time.Duration `json:"delay,omitempty" mapstructure:"delay"`
+	AbortPercent uint32        `json:"abortPercent,omitempty" mapstructure:"abortPercent"`
+	Until        time.Time     `json:"until" mapstructure:"until"`
+}
+
+func (e FaultExperiment) validate(now time.Time) error {
+	if e.Service == "" {
+		return errors.New("fault experiment requires a service")
+	}
+	if e.Until.IsZero() {
+		return errors.New("fault experiment requires an expiry time")
+	}
+	if !e.Until.After(now) {
+		return fmt.Errorf("fault experiment already expired at %s", e.Until.Format(time.RFC3339))
+	}
+	if e.DelayPercent > 100 || e.AbortPercent > 100 {
+		return errors.New("fault percentages must be between 0 and 100")
+	}
+	if e.DelayPercent > 0 && e.Delay <= 0 {
+		return errors.New("fault experiment with delayPercent requires a delay")
+	}
+	if e.DelayPercent == 0 && e.AbortPercent == 0 {
+		return errors.New("fault experiment injects nothing: set delayPercent and/or abortPercent")
+	}
+	return nil
+}
+
+// httpFault converts the experiment to the per-route configuration of the fault filter
+func (e FaultExperiment) httpFault() *fault.HTTPFault {
+	f := &fault.HTTPFault{}
+	if e.DelayPercent > 0 {
+		f.Delay = &commonfault.FaultDelay{
+			FaultDelaySecifier: &commonfault.FaultDelay_FixedDelay{FixedDelay: durationpb.New(e.Delay)},
+			Percentage:         &typev3.FractionalPercent{Numerator: e.DelayPercent, Denominator: typev3.FractionalPercent_HUNDRED},
+		}
+	}
+	if e.AbortPercent > 0 {
+		f.Abort = &fault.FaultAbort{
+			ErrorType:  &fault.FaultAbort_GrpcStatus{GrpcStatus: uint32(codes.Unavailable)},
+			Percentage: &typev3.FractionalPercent{Numerator: e.AbortPercent, Denominator: typev3.FractionalPercent_HUNDRED},
+		}
+	}
+	return f
+}
+
+// Faults keeps the running fault experiments and notifies watchers when they start or end.
+type Faults struct {
+	sync.Mutex
+	experiments map[string]FaultExperiment
+	timers      map[string]*time.Timer
+	changed     chan struct{}
+}
+
+// NewFaults reads the initial experiments from the `faults` config key
+func NewFaults(config *viper.Viper) (*Faults, error) {
+	f := &Faults{}
+	var experiments []FaultExperiment
+	err := config.UnmarshalKey("faults", &experiments, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+	)))
+	if err != nil {
+		return f, err
+	}
+	for _, e := range experiments {
+		if _, err := f.Add(e); err != nil {
+			zap.L().Warn("skipping fault experiment", zap.String("service", e.Service), zap.Error(err))
+		}
+	}
+	return f, nil
+}
+
+// Add starts an experiment. An experiment with the same service and zone is replaced.
+func (f *Faults) Add(e FaultExperiment) (FaultExperiment, error) {
+	now := time.Now()
+	if err := e.validate(now); err != nil {
+		return e, err
+	}
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.init()
+	for id, other := range f.experiments {
+		if other.Service == e.Service && other.Zone == e.Zone {
+			f.remove(id)
+		}
+	}
+	f.experiments[e.ID] = e
+	id := e.ID
+	f.timers[id] = time.AfterFunc(e.Until.Sub(now), func() {
+		zap.L().Info("Fault experiment expired", zap.String("id", id))
+		f.Remove(id)
+	})
+	zap.L().Info("Fault experiment started", zap.Any("experiment", e))
+	f.notify()
+	return e, nil
+}
+
+// Remove stops an experiment, it reports whether the experiment was running
+func (f *Faults) Remove(id string) bool {
+	f.Lock()
+	defer f.Unlock()
+	f.init()
+	if _, has := f.experiments[id]; !has {
+		return false
+	}
+	f.remove(id)
+	f.notify()
+	return true
+}
+
+func (f *Faults) remove(id string) {
+	if t, has := f.timers[id]; has {
+		t.Stop()
+	}
+	delete(f.timers, id)
+	delete(f.experiments, id)
+}
+
+// Active lists the running experiments, ordered by id
+func (f *Faults) Active() []FaultExperiment {
+	f.Lock()
+	defer f.Unlock()
+	now := time.Now()
+	active := []FaultExperiment{}
+	for _, e := range f.experiments {
+		if e.Until.After(now) {
+			active = append(active, e)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+	return active
+}
+
+// Changed returns a channel that is closed on the next change of the experiments
+func (f *Faults) Changed() <-chan struct{} {
+	f.Lock()
+	defer f.Unlock()
+	f.init()
+	return f.changed
+}
+
+func (f *Faults) init() {
+	if f.experiments == nil {
+		f.experiments = make(map[string]FaultExperiment)
+		f.timers = make(map[string]*time.Timer)
+	}
+	if f.changed == nil {
+		f.changed = make(chan struct{})
+	}
+}
+
+func (f *Faults) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// ServeHTTP implements the admin API for fault experiments:
+// GET lists, POST starts (with a `duration` instead of `until`) and DELETE ?id= stops an experiment.
+func (f *Faults) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, f.Active())
+	case http.MethodPost:
+		var body struct {
+			FaultExperiment
+			Delay    string `json:"delay"`
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e := body.FaultExperiment
+		if body.Delay != "" {
+			delay, err := time.ParseDuration(body.Delay)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			e.Delay = delay
+		}
+		if body.Duration != "" {
+			duration, err := time.ParseDuration(body.Duration)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			e.Until = time.Now().Add(duration)
+		}
+		e, err := f.Add(e)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(rw, http.StatusCreated, e)
+	case http.MethodDelete:
+		if !f.Remove(r.URL.Query().Get("id")) {
+			http.Error(rw, "no such experiment", http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// faultFor selects the experiment for calls from a node in ownZone to service.
+// A zone specific experiment takes precedence over one that targets all zones.
+func faultFor(experiments []FaultExperiment, service string, ownZone string) *FaultExperiment {
+	var match *FaultExperiment
+	for i, e := range experiments {
+		if e.Service != service {
+			continue
+		}
+		if e.Zone == ownZone && ownZone != "" {
+			return &experiments[i]
+		}
+		if e.Zone == "" && match == nil {
+			match = &experiments[i]
+		}
+	}
+	return match
+}
+
+// faultFilter installs the fault filter without defaults, the experiment itself is configured per route
+func faultFilter() *hcm.HttpFilter {
+	return &hcm.HttpFilter{
+		Name: wellknown.Fault,
+		ConfigType: &hcm.HttpFilter_TypedConfig{
+			TypedConfig: any(&fault.HTTPFault{}),
+		},
+	}
+}
+
+func faultPerFilterConfig(e *FaultExperiment) map[string]*anypb.Any {
+	if e == nil {
+		return nil
+	}
+	return map[string]*anypb.Any{wellknown.Fault: any(e.httpFault())}
+}
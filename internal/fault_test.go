@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	l "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	fault "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultsRequireExpiry(t *testing.T) {
+	f := &Faults{}
+	_, err := f.Add(FaultExperiment{Service: "example-server", AbortPercent: 10})
+	assert.Error(t, err)
+	_, err = f.Add(FaultExperiment{Service: "example-server", AbortPercent: 10, Until: time.Now().Add(-time.Minute)})
+	assert.Error(t, err)
+	assert.Empty(t, f.Active())
+}
+
+func TestFaultsExpire(t *testing.T) {
+	f := &Faults{}
+	changed := f.Changed()
+	e, err := f.Add(FaultExperiment{Service: "example-server", AbortPercent: 10, Until: time.Now().Add(50 * time.Millisecond)})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, e.ID)
+	<-changed
+	assert.Len(t, f.Active(), 1)
+
+	select {
+	case <-f.Changed():
+	case <-time.After(time.Second):
+		t.Fatal("experiment did not expire")
+	}
+	assert.Empty(t, f.Active())
+}
+
+func TestFaultsReplaceSameServiceAndZone(t *testing.T) {
+	f := &Faults{}
+	until := time.Now().Add(time.Minute)
+	a, _ := f.Add(FaultExperiment{Service: "example-server", AbortPercent: 10, Until: until})
+	b, _ := f.Add(FaultExperiment{Service: "example-server", AbortPercent: 20, Until: until})
+	c, _ := f.Add(FaultExperiment{Service: "example-server", Zone: "europe-west4-a", AbortPercent: 30, Until: until})
+	assert.ElementsMatch(t, []FaultExperiment{b, c}, f.Active())
+	assert.False(t, f.Remove(a.ID))
+	assert.True(t, f.Remove(b.ID))
+}
+
+func TestGenerateSnapshotFaults(t *testing.T) {
+	experiments := []FaultExperiment{{
+		ID:           "abort",
+		Service:      "example-server",
+		Zone:         "europe-west4-a",
+		AbortPercent: 100,
+		Until:        time.Now().Add(time.Minute),
+	}}
+	mapping := Mapping{"example-server": {
+		"europe-west4-a": {{IP: "127.0.0.1", Port: 8000, Zone: "europe-west4-a"}},
+	}}
+
+	inZone := &core.Node{Id: "a", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	ss, err := GenerateSnapshot(inZone, mapping, Options{Faults: experiments})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{wellknown.Fault, "router"}, httpFilterNames(t, ss.GetResources(resource.ListenerType)["example-server"].(*l.Listener)))
+	rc := ss.GetResources(resource.RouteType)["example-server-route"].(*route.RouteConfiguration)
+	perRoute := &fault.HTTPFault{}
+	assert.NoError(t, rc.VirtualHosts[0].Routes[0].TypedPerFilterConfig[wellknown.Fault].UnmarshalTo(perRoute))
+	assert.Equal(t, uint32(100), perRoute.Abort.Percentage.Numerator)
+	assert.Equal(t, uint32(14), perRoute.Abort.GetGrpcStatus())
+
+	otherZone := &core.Node{Id: "b", Locality: &core.Locality{Zone: "europe-west4-b"}}
+	ss, err = GenerateSnapshot(otherZone, mapping, Options{Faults: experiments})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"router"}, httpFilterNames(t, ss.GetResources(resource.ListenerType)["example-server"].(*l.Listener)))
+	rc = ss.GetResources(resource.RouteType)["example-server-route"].(*route.RouteConfiguration)
+	assert.Empty(t, rc.VirtualHosts[0].Routes[0].TypedPerFilterConfig)
+}
+
+func httpFilterNames(t *testing.T, listener *l.Listener) (names []string) {
+	manager := &hcm.HttpConnectionManager{}
+	assert.NoError(t, listener.ApiListener.ApiListener.UnmarshalTo(manager))
+	for _, f := range manager.HttpFilters {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestFaultsAdminToken(t *testing.T) {
+	handler := requireToken("secret", &Faults{})
+	post := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/faults", strings.NewReader(`{"service": "example-server", "abortPercent": 10, "duration": "1m"}`))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, http.StatusUnauthorized, post("wrong"))
+	assert.Equal(t, http.StatusCreated, post("secret"))
+	// reads need no token
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/faults", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
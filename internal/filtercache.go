@@ -5,57 +5,143 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"sync"
+	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"go.uber.org/zap"
 )
 
 type FilterCache struct {
 	sync.Mutex
-	lookup map[string]struct {
-		cache.SnapshotCache
-		*core.Node
-	}
-	createFn func(node *core.Node) cache.SnapshotCache
+	ctx    context.Context
+	lookup map[string]filterCacheEntry
+	// createFn creates the cache of a class of nodes, ctx is done once the nodes are released
+	createFn func(ctx context.Context, node *core.Node, subscriptions *Subscriptions) cache.SnapshotCache
+	// streamOf tells the stream of a request, and whether it is an ADS stream
+	streamOf func(req interface{}) (streamKey, bool)
+}
+
+type filterCacheEntry struct {
+	cache.SnapshotCache
+	*core.Node
+	subscriptions *Subscriptions
+	ctx           context.Context
+	cancel        context.CancelFunc
 }
 
 var _ cache.Cache = &FilterCache{}
 
-func (fc *FilterCache) get(node *core.Node) cache.Cache {
+func (fc *FilterCache) get(node *core.Node) filterCacheEntry {
 	fc.Lock()
 	defer fc.Unlock()
-	key := AsSha256(node)
+	key := nodeKey(node)
 	if fc.lookup == nil {
-		fc.lookup = make(map[string]struct {
-			cache.SnapshotCache
-			*core.Node
-		})
+		fc.lookup = make(map[string]filterCacheEntry)
 	}
 	if _, has := fc.lookup[key]; !has {
-		fc.lookup[key] = struct {
-			cache.SnapshotCache
-			*core.Node
-		}{
-			SnapshotCache: fc.createFn(node),
+		parent := fc.ctx
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithCancel(parent)
+		subscriptions := &Subscriptions{}
+		fc.lookup[key] = filterCacheEntry{
+			SnapshotCache: fc.createFn(ctx, node, subscriptions),
 			Node:          node,
+			subscriptions: subscriptions,
+			ctx:           ctx,
+			cancel:        cancel,
+		}
+	}
+	return fc.lookup[key]
+}
+
+// Release removes the cache of the class of the node, stopping the generation of its snapshots
+func (fc *FilterCache) Release(node *core.Node) {
+	fc.Lock()
+	defer fc.Unlock()
+	key := nodeKey(node)
+	if entry, has := fc.lookup[key]; has {
+		zap.L().Info("Releasing Node class", zap.String("class", key))
+		entry.cancel()
+		delete(fc.lookup, key)
+	}
+}
+
+// Closed drops the subscriptions of the stream, and stops following the snapshots of its class
+func (fc *FilterCache) Closed(id streamKey) {
+	fc.Lock()
+	defer fc.Unlock()
+	for _, entry := range fc.lookup {
+		entry.subscriptions.Remove(id)
+		if c, ok := entry.SnapshotCache.(*classCache); ok {
+			c.closeStream(id)
 		}
 	}
-	return fc.lookup[key].SnapshotCache
+}
+
+// stream of the request, and whether it is an ADS stream
+func (fc *FilterCache) stream(req interface{}) (streamKey, bool) {
+	if fc.streamOf == nil {
+		return streamKey{}, false
+	}
+	return fc.streamOf(req)
+}
+
+// watcher of the stream: ADS streams watch the stage of the class they have, the other streams the class itself
+func (e filterCacheEntry) watcher(id streamKey, ads bool) cache.ConfigWatcher {
+	if c, ok := e.SnapshotCache.(*classCache); ok && ads {
+		return c.watcher(id)
+	}
+	return e
+}
+
+// Len is the number of node classes with a cache
+func (fc *FilterCache) Len() int {
+	fc.Lock()
+	defer fc.Unlock()
+	return len(fc.lookup)
 }
 
 var _ cache.Cache = &FilterCache{}
 
 func (fc *FilterCache) CreateWatch(req *cache.Request, ss stream.StreamState, resp chan cache.Response) (cancel func()) {
-	return fc.get(req.Node).CreateWatch(req, ss, resp)
+	entry := fc.get(req.Node)
+	id, ads := fc.stream(req)
+	entry.wait(req.TypeUrl, req.ResourceNames, entry.subscriptions.Add(id, req.TypeUrl, req.ResourceNames, len(req.ResourceNames) == 0))
+	return entry.watcher(id, ads).CreateWatch(req, ss, resp)
 }
 
 func (fc *FilterCache) CreateDeltaWatch(req *cache.DeltaRequest, ss stream.StreamState, resp chan cache.DeltaResponse) (cancel func()) {
-	return fc.get(req.Node).CreateDeltaWatch(req, ss, resp)
+	entry := fc.get(req.Node)
+	id, ads := fc.stream(req)
+	version := entry.subscriptions.Update(id, req.TypeUrl, req.ResourceNamesSubscribe, req.ResourceNamesUnsubscribe, ss.IsWildcard())
+	entry.wait(req.TypeUrl, req.ResourceNamesSubscribe, version)
+	return entry.watcher(id, ads).CreateDeltaWatch(req, ss, resp)
 }
 
 func (fc *FilterCache) Fetch(ctx context.Context, req *cache.Request) (cache.Response, error) {
-	return fc.get(req.Node).Fetch(ctx, req)
+	entry := fc.get(req.Node)
+	// fetches have no stream, their subscriptions last until the class is released
+	entry.wait(req.TypeUrl, req.ResourceNames, entry.subscriptions.Add(streamKey{}, req.TypeUrl, req.ResourceNames, len(req.ResourceNames) == 0))
+	return entry.Fetch(ctx, req)
+}
+
+// subscriptionTimeout bounds the wait for the snapshot with newly subscribed resources. The worker of the class does not
+// wait for clients, so this only waits for the generation of the snapshot.
+const subscriptionTimeout = time.Second
+
+// wait until the subscriptions up to the version are generated, so the response includes the requested resources
+func (e filterCacheEntry) wait(typeURL string, names []string, version uint64) {
+	if version > 0 {
+		ctx, cancel := context.WithTimeout(e.ctx, subscriptionTimeout)
+		defer cancel()
+		if !e.subscriptions.Wait(ctx, version) {
+			zap.L().Warn("Timeout generating subscribed resources", zap.String("type", typeURL), zap.Strings("names", names))
+		}
+	}
 }
 
 // https://blog.8bitzen.com/posts/22-08-2019-how-to-hash-a-struct-in-go
@@ -0,0 +1,418 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// HealthCheckConfig configures the active health checks of the control plane, read from the `healthCheck` config key
+type HealthCheckConfig struct {
+	// Interval between the probes of an endpoint, zero disables the health checks
+	Interval time.Duration `mapstructure:"interval"`
+	// Timeout of a probe, defaults to a second
+	Timeout time.Duration `mapstructure:"timeout"`
+	// HealthyThreshold is the number of consecutive successful probes that make an unhealthy endpoint healthy, defaults to 2
+	HealthyThreshold int `mapstructure:"healthyThreshold"`
+	// UnhealthyThreshold is the number of consecutive failed probes that make an endpoint unhealthy, defaults to 3
+	UnhealthyThreshold int `mapstructure:"unhealthyThreshold"`
+	// Concurrency is the number of endpoints that are probed at the same time, defaults to 16
+	Concurrency int `mapstructure:"concurrency"`
+	// Shard of the endpoints that this replica probes, out of Shards, like the ordinal of a StatefulSet
+	Shard  int `mapstructure:"shard"`
+	Shards int `mapstructure:"shards"`
+	// Peers are the admin URLs of the other replicas, like http://k8s-xds-1.k8s-xds:9001, of which the results are fetched
+	Peers []string `mapstructure:"peers"`
+}
+
+// HealthChecker probes the discovered endpoints with grpc.health.v1.Health/Check, as proxyless gRPC clients cannot,
+// from the control plane instead of from the node of the endpoint like the readiness probes of the kubelet.
+// Endpoints that fail are marked UNHEALTHY in EDS. A nil HealthChecker considers all endpoints healthy.
+type HealthChecker struct {
+	HealthCheckConfig
+	Services Services
+	Security SecurityConfig
+
+	mu      sync.Mutex
+	probes  map[string]*probe          // address -> results of the own probes
+	remote  map[string]map[string]bool // peer -> address -> healthy
+	conns   map[string]*grpc.ClientConn
+	changed chan struct{}
+}
+
+// healthTarget is an endpoint to probe, with the names of the gRPC services to check ("" checks the server)
+type healthTarget struct {
+	address  string
+	services []string
+}
+
+type probe struct {
+	healthy             bool
+	successes, failures int
+}
+
+// HealthCheckResult is the verdict on an endpoint, as served to the peers
+type HealthCheckResult struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+}
+
+// NewHealthChecker reads the `healthCheck` config key, it returns nil when the health checks are disabled
+func NewHealthChecker(config *viper.Viper, services Services, security SecurityConfig) (*HealthChecker, error) {
+	var cfg HealthCheckConfig
+	if err := config.UnmarshalKey("healthCheck", &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Interval <= 0 {
+		return nil, nil
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = 2
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = 3
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 16
+	}
+	if cfg.Shards > 0 && (cfg.Shard < 0 || cfg.Shard >= cfg.Shards) {
+		return nil, fmt.Errorf("health check shard %d out of %d shards", cfg.Shard, cfg.Shards)
+	}
+	return &HealthChecker{HealthCheckConfig: cfg, Services: services, Security: security}, nil
+}
+
+// Run probes the endpoints of the discovered mappings every interval, until ctx is done
+func (h *HealthChecker) Run(ctx context.Context, d Discovery) {
+	stream := d.Watch(ctx)
+	t := time.NewTicker(h.Interval)
+	defer t.Stop()
+	// the rounds run in a worker, so the mappings are received while it probes
+	rounds := make(chan []healthTarget, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for targets := range rounds {
+			h.round(ctx, targets)
+		}
+	}()
+	defer func() {
+		close(rounds)
+		<-done
+		h.close()
+	}()
+	var targets []healthTarget
+	// schedule a round of the latest targets, instead of a round that did not start yet
+	schedule := func() {
+		select {
+		case <-rounds:
+		default:
+		}
+		rounds <- targets
+	}
+	first := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-stream:
+			targets = h.targets(m)
+			// the first round does not wait for the interval
+			if first {
+				first = false
+				schedule()
+			}
+		case <-t.C:
+			schedule()
+		}
+	}
+}
+
+// targets are the addresses of the Pods of the shard of this replica, with the configured grpcServices of their service.
+// Endpoints that the probes cannot reach are left out: TCP services, services with mutual TLS, ClusterIPs and DNS names,
+// and draining endpoints.
+func (h *HealthChecker) targets(m Mapping) []healthTarget {
+	services := map[string][]string{}
+	for service, zones := range m {
+		cfg := h.Services[service]
+		if cfg.Protocol == protocolTCP || h.Security.enabled(cfg) {
+			continue
+		}
+		names := cfg.GrpcServices
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, endpoints := range zones {
+			for _, e := range endpoints {
+				if e.ClusterIP || e.Hostname != "" || e.Draining {
+					continue
+				}
+				address := net.JoinHostPort(e.IP, fmt.Sprint(e.Port))
+				if !h.owns(address) {
+					continue
+				}
+				// a Pod can serve several services on a port
+				for _, name := range names {
+					if !Contains(services[address], name) {
+						services[address] = append(services[address], name)
+					}
+				}
+			}
+		}
+	}
+	targets := make([]healthTarget, 0, len(services))
+	for address, names := range services {
+		sort.Strings(names)
+		targets = append(targets, healthTarget{address: address, services: names})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].address < targets[j].address })
+	return targets
+}
+
+// owns tells if the address is in the shard of this replica
+func (h *HealthChecker) owns(address string) bool {
+	if h.Shards <= 1 {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(address))
+	return int(hash.Sum32()%uint32(h.Shards)) == h.Shard
+}
+
+// round probes the targets, Concurrency at a time, and fetches the results of the peers
+func (h *HealthChecker) round(ctx context.Context, targets []healthTarget) {
+	results := make([]bool, len(targets))
+	next := make(chan int, len(targets))
+	for i := range targets {
+		next <- i
+	}
+	close(next)
+	var wg sync.WaitGroup
+	for w := 0; w < h.Concurrency && w < len(targets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = h.check(ctx, targets[i])
+			}
+		}()
+	}
+	remote := map[string]map[string]bool{}
+	var unreachable []string
+	for _, peer := range h.Peers {
+		if results, err := fetchHealthChecks(ctx, peer, h.Timeout); err != nil {
+			zap.L().Warn("Failed to fetch the health checks of a peer, keeping its last results", zap.String("peer", peer), zap.Error(err))
+			unreachable = append(unreachable, peer)
+		} else {
+			remote[peer] = results
+		}
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.init()
+	// the endpoints of an unreachable peer keep their last known status, instead of all becoming healthy
+	for _, peer := range unreachable {
+		if results, has := h.remote[peer]; has {
+			remote[peer] = results
+		}
+	}
+	changed := !reflect.DeepEqual(h.remote, remote)
+	h.remote = remote
+	current := make(map[string]bool, len(targets))
+	for i, target := range targets {
+		current[target.address] = true
+		changed = h.record(target.address, results[i]) || changed
+	}
+	// forget the endpoints that are gone
+	for address, p := range h.probes {
+		if !current[address] {
+			delete(h.probes, address)
+			changed = changed || !p.healthy
+		}
+	}
+	for address, conn := range h.conns {
+		if !current[address] {
+			conn.Close()
+			delete(h.conns, address)
+		}
+	}
+	if changed {
+		close(h.changed)
+		h.changed = make(chan struct{})
+	}
+}
+
+// check calls the health service of the endpoint for each of its gRPC services, which must all be serving. Servers
+// without a health service are healthy when they answer.
+func (h *HealthChecker) check(ctx context.Context, target healthTarget) bool {
+	conn, err := h.conn(target.address)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	for _, service := range target.services {
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if status.Code(err) == codes.Unimplemented {
+			return true
+		} else if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *HealthChecker) conn(address string) (*grpc.ClientConn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.init()
+	if conn, has := h.conns[address]; has {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	h.conns[address] = conn
+	return conn, nil
+}
+
+// record the result of a probe, it returns whether the endpoint changed between healthy and unhealthy. New endpoints
+// are healthy until they fail UnhealthyThreshold probes in a row.
+func (h *HealthChecker) record(address string, ok bool) bool {
+	p, has := h.probes[address]
+	if !has {
+		p = &probe{healthy: true}
+		h.probes[address] = p
+	}
+	if ok {
+		p.successes, p.failures = p.successes+1, 0
+		if !p.healthy && p.successes >= h.HealthyThreshold {
+			p.healthy = true
+			return true
+		}
+	} else {
+		p.successes, p.failures = 0, p.failures+1
+		if p.healthy && p.failures >= h.UnhealthyThreshold {
+			p.healthy = false
+			return true
+		}
+	}
+	return false
+}
+
+// Status of the endpoint in EDS, by the own probes or those of the peers
+func (h *HealthChecker) Status(e podEndPoint) core.HealthStatus {
+	if h == nil || e.ClusterIP || e.Hostname != "" {
+		return core.HealthStatus_HEALTHY
+	}
+	address := net.JoinHostPort(e.IP, fmt.Sprint(e.Port))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, has := h.probes[address]; has && !p.healthy {
+		return core.HealthStatus_UNHEALTHY
+	}
+	for _, results := range h.remote {
+		if healthy, has := results[address]; has && !healthy {
+			return core.HealthStatus_UNHEALTHY
+		}
+	}
+	return core.HealthStatus_HEALTHY
+}
+
+// Changed returns a channel that is closed on the next change of the health of an endpoint, a nil HealthChecker never changes
+func (h *HealthChecker) Changed() <-chan struct{} {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.init()
+	return h.changed
+}
+
+// Results are the verdicts of the own probes
+func (h *HealthChecker) Results() []HealthCheckResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	results := make([]HealthCheckResult, 0, len(h.probes))
+	for address, p := range h.probes {
+		results = append(results, HealthCheckResult{Address: address, Healthy: p.healthy})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Address < results[j].Address })
+	return results
+}
+
+// ServeHTTP implements the admin API for the health checks, which the peers fetch
+func (h *HealthChecker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, http.StatusOK, h.Results())
+}
+
+func fetchHealthChecks(ctx context.Context, peer string, timeout time.Duration) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/healthchecks", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var results []HealthCheckResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	healthy := make(map[string]bool, len(results))
+	for _, r := range results {
+		healthy[r.Address] = r.Healthy
+	}
+	return healthy, nil
+}
+
+func (h *HealthChecker) init() {
+	if h.probes == nil {
+		h.probes = make(map[string]*probe)
+		h.conns = make(map[string]*grpc.ClientConn)
+	}
+	if h.changed == nil {
+		h.changed = make(chan struct{})
+	}
+}
+
+func (h *HealthChecker) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for address, conn := range h.conns {
+		conn.Close()
+		delete(h.conns, address)
+	}
+}
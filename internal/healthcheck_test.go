@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	examplev1 "github.com/hermanbanken/k8s-xds/example/pkg/gen/v1"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/xds"
+)
+
+func TestHealthCheckHysteresis(t *testing.T) {
+	h := &HealthChecker{HealthCheckConfig: HealthCheckConfig{HealthyThreshold: 2, UnhealthyThreshold: 3}}
+	h.init()
+	e := podEndPoint{IP: "10.0.0.1", Port: 8080}
+	for i, ok := range []bool{false, false, true, false, false} {
+		assert.False(t, h.record("10.0.0.1:8080", ok), i)
+	}
+	assert.True(t, h.record("10.0.0.1:8080", false))
+	assert.Equal(t, core.HealthStatus_UNHEALTHY, h.Status(e))
+	assert.False(t, h.record("10.0.0.1:8080", true))
+	assert.True(t, h.record("10.0.0.1:8080", true))
+	assert.Equal(t, core.HealthStatus_HEALTHY, h.Status(e))
+
+	// the results of the peers count for the endpoints of their shards
+	h.remote = map[string]map[string]bool{"http://k8s-xds-1:9001": {"10.0.0.2:8080": false}}
+	assert.Equal(t, core.HealthStatus_UNHEALTHY, h.Status(podEndPoint{IP: "10.0.0.2", Port: 8080}))
+	var disabled *HealthChecker
+	assert.Equal(t, core.HealthStatus_HEALTHY, disabled.Status(podEndPoint{IP: "10.0.0.2", Port: 8080}))
+}
+
+func TestHealthCheckShards(t *testing.T) {
+	mapping := Mapping{"a": {"europe-west4-a": {
+		{IP: "10.0.0.1", Port: 8080}, {IP: "10.0.0.2", Port: 8080}, {IP: "10.0.0.3", Port: 8080}, {IP: "10.0.0.4", Port: 8080},
+	}}}
+	var all []string
+	for shard := 0; shard < 2; shard++ {
+		h := &HealthChecker{HealthCheckConfig: HealthCheckConfig{Shard: shard, Shards: 2}}
+		for _, target := range h.targets(mapping) {
+			all = append(all, target.address)
+			assert.Equal(t, []string{""}, target.services)
+		}
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080"}, all)
+
+	// the probes check the gRPC services of the service
+	h := &HealthChecker{Services: Services{"a": {GrpcServices: []string{"search.v1.Search", "example.v1.Example"}}}}
+	targets := h.targets(Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080}}}})
+	assert.Equal(t, []healthTarget{{address: "10.0.0.1:8080", services: []string{"example.v1.Example", "search.v1.Search"}}}, targets)
+
+	// the probes cannot reach TCP services
+	h = &HealthChecker{Services: Services{"a": {Protocol: protocolTCP}}}
+	assert.Empty(t, h.targets(mapping))
+}
+
+func TestHealthCheckGrpcServices(t *testing.T) {
+	grpcServer := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("example.v1.Example", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("search.v1.Search", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	lis, err := net.Listen("tcp", ":8190")
+	assert.NoError(t, err)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	h := &HealthChecker{HealthCheckConfig: HealthCheckConfig{Timeout: time.Second, UnhealthyThreshold: 2, Concurrency: 1}}
+	h.init()
+	defer h.close()
+	ctx := context.TODO()
+	assert.True(t, h.check(ctx, healthTarget{address: "localhost:8190", services: []string{""}}))
+	assert.True(t, h.check(ctx, healthTarget{address: "localhost:8190", services: []string{"example.v1.Example"}}))
+	assert.False(t, h.check(ctx, healthTarget{address: "localhost:8190", services: []string{"example.v1.Example", "search.v1.Search"}}))
+	// a service that the server does not know fails
+	assert.False(t, h.check(ctx, healthTarget{address: "localhost:8190", services: []string{"search.v1.Unknown"}}))
+
+	// the workers probe all targets of a round
+	targets := []healthTarget{
+		{address: "localhost:8190", services: []string{"example.v1.Example"}},
+		{address: "127.0.0.1:8190", services: []string{"search.v1.Search"}},
+	}
+	for i := 0; i < 2; i++ {
+		h.round(ctx, targets)
+	}
+	assert.Equal(t, core.HealthStatus_HEALTHY, h.Status(podEndPoint{IP: "localhost", Port: 8190}))
+	assert.Equal(t, core.HealthStatus_UNHEALTHY, h.Status(podEndPoint{IP: "127.0.0.1", Port: 8190}))
+}
+
+// TestHealthCheckFirstRound probes the first mapping without waiting for the interval
+func TestHealthCheckFirstRound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	h := &HealthChecker{HealthCheckConfig: HealthCheckConfig{Interval: time.Hour, Timeout: 100 * time.Millisecond, UnhealthyThreshold: 1, Concurrency: 1}}
+	discovery := &manualDiscovery{}
+	go h.Run(ctx, discovery)
+	e := podEndPoint{IP: "127.0.0.1", Port: 8201}
+	assert.Eventually(t, func() bool {
+		discovery.Emit(Mapping{"a": {"europe-west4-a": {e}}})
+		return h.Status(e) == core.HealthStatus_UNHEALTHY
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestHealthCheckUnreachablePeer(t *testing.T) {
+	peer := &http.Server{Addr: ":8200", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, []HealthCheckResult{{Address: "10.0.0.2:8080", Healthy: false}})
+	})}
+	go peer.ListenAndServe()
+	h := &HealthChecker{HealthCheckConfig: HealthCheckConfig{Timeout: time.Second, Concurrency: 1, Peers: []string{"http://localhost:8200"}}}
+	ctx := context.TODO()
+	e := podEndPoint{IP: "10.0.0.2", Port: 8080}
+	assert.Eventually(t, func() bool {
+		h.round(ctx, nil)
+		return h.Status(e) == core.HealthStatus_UNHEALTHY
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the endpoints of the peer keep their status while it is unreachable
+	assert.NoError(t, peer.Close())
+	changed := h.Changed()
+	h.round(ctx, nil)
+	assert.Equal(t, core.HealthStatus_UNHEALTHY, h.Status(e))
+	select {
+	case <-changed:
+		t.Error("unreachable peer changed the health of its endpoints")
+	default:
+	}
+}
+
+// runHealthServer runs an example server with a health service that reports the status
+func runHealthServer(port int, status healthpb.HealthCheckResponse_ServingStatus) {
+	grpcServer := grpc.NewServer()
+	examplev1.RegisterExampleServer(grpcServer, example{port: port})
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", status)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	grpcServer.Serve(lis)
+}
+
+// TestXdsHealthCheck stops sending calls to the endpoint that fails its health checks
+func TestXdsHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	go runServer(8140)
+	go runHealthServer(8141, healthpb.HealthCheckResponse_NOT_SERVING)
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9140)
+	config.Set("admin.port", 9141)
+	config.Set("healthCheck.interval", "100ms")
+	config.Set("healthCheck.unhealthyThreshold", 2)
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"example-server": {"europe-west4-a": {
+		{IP: "127.0.0.1", Port: 8140, Zone: "europe-west4-a"},
+		{IP: "127.0.0.1", Port: 8141, Zone: "europe-west4-a"},
+	}}})
+
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://localhost:9141/healthchecks")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		var results []HealthCheckResult
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			return false
+		}
+		return assert.ObjectsAreEqual([]HealthCheckResult{{Address: "127.0.0.1:8140", Healthy: true}, {Address: "127.0.0.1:8141", Healthy: false}}, results)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting([]byte(`{
+  "xds_servers": [{"server_uri": "localhost:9140", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "node": {"id": "health-client", "locality": {"zone": "europe-west4-a"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := grpc.DialContext(ctx, "xds:///example-server", grpc.WithInsecure(), grpc.WithResolvers(resolver))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "Hi hello world from 8140", runClient(ctx, c))
+	}
+}
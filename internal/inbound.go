@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	l "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	rbacconfig "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	v3routerpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"go.uber.org/zap"
+)
+
+// serviceMetadataKey is the node metadata key with which xDS enabled gRPC servers tell which service they serve
+const serviceMetadataKey = "SERVICE"
+
+// serverListenerNameTemplate is the default server_listener_resource_name_template of gRPC
+const serverListenerNameTemplate = "grpc/server?xds.resource.listening_address=%s"
+
+// AuthorizationPolicy allows calls to Methods by Principals.
+// Methods are full gRPC paths (/package.Service/Method); a path ending in a slash matches all methods of the service.
+// Principals are the names (URI/DNS SAN) of authenticated peers. Leaving either empty matches anything.
+type AuthorizationPolicy struct {
+	Name       string   `mapstructure:"name"`
+	Methods    []string `mapstructure:"methods"`
+	Principals []string `mapstructure:"principals"`
+}
+
+// nodeService returns the service served by an xDS enabled gRPC server node
+func nodeService(node *core.Node) string {
+	return node.GetMetadata().GetFields()[serviceMetadataKey].GetStringValue()
+}
+
+// servicePorts lists the ports that the servers of the service listen on
+func servicePorts(zones map[string][]podEndPoint, cfg ServiceConfig) []uint32 {
+	if cfg.Port != 0 {
+		return []uint32{cfg.Port}
+	}
+	seen := map[uint32]bool{}
+	ports := []uint32{}
+	for _, endpoints := range zones {
+		for _, e := range endpoints {
+			if !seen[uint32(e.Port)] {
+				seen[uint32(e.Port)] = true
+				ports = append(ports, uint32(e.Port))
+			}
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// createInboundListeners creates the listeners requested by xDS enabled gRPC servers.
+// Servers listening on ":port" request the IPv6 wildcard address, so both wildcard addresses are served.
+// With a transportSocket, the servers only accept (mutual) TLS connections.
+func createInboundListeners(naming resourceNaming, service string, ports []uint32, cfg ServiceConfig, transportSocket *core.TransportSocket) []types.Resource {
+	var lds []types.Resource
+	for _, port := range ports {
+		for _, ip := range []string{"0.0.0.0", "::"} {
+			address := net.JoinHostPort(ip, fmt.Sprint(port))
+			lds = append(lds, createInboundListener(naming.inbound(address), service, ip, port, cfg, transportSocket))
+		}
+	}
+	return lds
+}
+
+func createInboundListener(listenerName string, service string, ip string, port uint32, cfg ServiceConfig, transportSocket *core.TransportSocket) *l.Listener {
+	zap.L().Debug("Creating INBOUND LISTENER", zap.String("name", listenerName))
+	httpFilters := []*hcm.HttpFilter{}
+	if len(cfg.Authorization) > 0 {
+		httpFilters = append(httpFilters, rbacFilter(cfg.Authorization))
+	}
+	httpFilters = append(httpFilters, &hcm.HttpFilter{
+		Name: "router",
+		ConfigType: &hcm.HttpFilter_TypedConfig{
+			TypedConfig: any(&v3routerpb.Router{}),
+		},
+	})
+	manager := any(&hcm.HttpConnectionManager{
+		CodecType:  hcm.HttpConnectionManager_AUTO,
+		StatPrefix: fmt.Sprintf("inbound_%s", service),
+		RouteSpecifier: &hcm.HttpConnectionManager_RouteConfig{
+			RouteConfig: &route.RouteConfiguration{
+				Name: fmt.Sprintf("%s-inbound-route", service),
+				VirtualHosts: []*route.VirtualHost{{
+					Name:    fmt.Sprintf("%s-inbound-vhost", service),
+					Domains: []string{"*"},
+					Routes: []*route.Route{{
+						Match: &route.RouteMatch{
+							PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+						},
+						Action: &route.Route_NonForwardingAction{
+							NonForwardingAction: &route.NonForwardingAction{},
+						},
+					}},
+				}},
+			},
+		},
+		HttpFilters: httpFilters,
+	})
+	return &l.Listener{
+		Name: listenerName,
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.SocketAddress_TCP,
+					Address:  ip,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: port,
+					},
+				},
+			},
+		},
+		FilterChains: []*l.FilterChain{{
+			Name: fmt.Sprintf("%s-inbound", service),
+			Filters: []*l.Filter{{
+				Name: wellknown.HTTPConnectionManager,
+				ConfigType: &l.Filter_TypedConfig{
+					TypedConfig: manager,
+				},
+			}},
+			TransportSocket: transportSocket,
+		}},
+	}
+}
+
+// rbacFilter allows calls matching any of the policies and denies all others
+func rbacFilter(policies []AuthorizationPolicy) *hcm.HttpFilter {
+	rules := &rbacconfig.RBAC{
+		Action:   rbacconfig.RBAC_ALLOW,
+		Policies: map[string]*rbacconfig.Policy{},
+	}
+	for i, policy := range policies {
+		name := policy.Name
+		if name == "" {
+			name = fmt.Sprintf("policy-%d", i)
+		}
+		p := &rbacconfig.Policy{}
+		for _, method := range policy.Methods {
+			p.Permissions = append(p.Permissions, &rbacconfig.Permission{
+				Rule: &rbacconfig.Permission_UrlPath{UrlPath: &matcher.PathMatcher{
+					Rule: &matcher.PathMatcher_Path{Path: pathMatcher(method)},
+				}},
+			})
+		}
+		if len(p.Permissions) == 0 {
+			p.Permissions = []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}}
+		}
+		for _, principal := range policy.Principals {
+			p.Principals = append(p.Principals, &rbacconfig.Principal{
+				Identifier: &rbacconfig.Principal_Authenticated_{Authenticated: &rbacconfig.Principal_Authenticated{
+					PrincipalName: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: principal}},
+				}},
+			})
+		}
+		if len(p.Principals) == 0 {
+			p.Principals = []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_Any{Any: true}}}
+		}
+		rules.Policies[name] = p
+	}
+	return &hcm.HttpFilter{
+		Name: wellknown.HTTPRoleBasedAccessControl,
+		ConfigType: &hcm.HttpFilter_TypedConfig{
+			TypedConfig: any(&rbac.RBAC{Rules: rules}),
+		},
+	}
+}
+
+func pathMatcher(method string) *matcher.StringMatcher {
+	if strings.HasSuffix(method, "/") {
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: method}}
+	}
+	return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: method}}
+}
@@ -11,17 +11,22 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/backoff/v2"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/discovery/v1"
 	"k8s.io/api/discovery/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 )
@@ -48,6 +53,8 @@ func (w *watcher) WatchLooped(ctx context.Context, fn func(watch.Event), opt met
 					w.resourceVersion = es.ResourceVersion
 				} else if es, ok := e.Object.(*v1.EndpointSlice); ok {
 					w.resourceVersion = es.ResourceVersion
+				} else if svc, ok := e.Object.(*corev1.Service); ok {
+					w.resourceVersion = svc.ResourceVersion
 				}
 				opt.ResourceVersion = w.resourceVersion
 			} else {
@@ -95,6 +102,7 @@ func KubernetesEndpointWatch(ctx context.Context, fn func(watch.EventType, Slice
 	// Somehow 'paths' does not work in 'kind'; sofar only tested to work in GKE
 	registered, _ := paths(m)
 	continueIfPathsUnknown := len(registered.Paths) == 0
+	accounts := watchServiceAccounts(ctx, m, fn)
 
 	if continueIfPathsUnknown || registered.Has("/apis/discovery.k8s.io/v1") {
 		zap.L().Debug("Using /apis/discovery.k8s.io/v1")
@@ -103,6 +111,7 @@ func KubernetesEndpointWatch(ctx context.Context, fn func(watch.EventType, Slice
 			if es, ok := e.Object.(*v1.EndpointSlice); ok {
 				slice := Slice{}
 				slice.FromV1(es)
+				accounts.resolve(e.Type, &slice)
 				fn(e.Type, slice)
 			}
 		}, metav1.ListOptions{})
@@ -113,6 +122,7 @@ func KubernetesEndpointWatch(ctx context.Context, fn func(watch.EventType, Slice
 			if es, ok := e.Object.(*v1beta1.EndpointSlice); ok {
 				slice := Slice{}
 				slice.FromV1Beta1(es)
+				accounts.resolve(e.Type, &slice)
 				fn(e.Type, slice)
 			}
 		}, metav1.ListOptions{})
@@ -121,6 +131,170 @@ func KubernetesEndpointWatch(ctx context.Context, fn func(watch.EventType, Slice
 	}
 }
 
+// KubernetesServiceWatch watches the Services, for the ClusterIPs and ExternalNames that the EndpointSlices do not tell
+func KubernetesServiceWatch(ctx context.Context, fn func(watch.EventType, ServiceInfo)) error {
+	m := client()
+	w := &watcher{Fn: m.CoreV1().Services(Namespace()).Watch}
+	return w.WatchLooped(ctx, func(e watch.Event) {
+		if svc, ok := e.Object.(*corev1.Service); ok {
+			info := ServiceInfo{}
+			info.FromV1(svc)
+			fn(e.Type, info)
+		}
+	}, metav1.ListOptions{})
+}
+
+// serviceAccounts resolves the ServiceAccounts of the Pods behind the EndpointSlices,
+// which are the identities of the servers when using mutual TLS, and when the Pods became ready, for slow start.
+type serviceAccounts struct {
+	sync.Mutex
+	pods     corelisters.PodNamespaceLister
+	accounts map[string]*podAccount // pod name -> ServiceAccount
+	slices   map[string]Slice       // slice name -> last resolved slice
+}
+
+// podAccount is the ServiceAccount and Ready time of a Pod, counted by the slices that refer to the Pod
+type podAccount struct {
+	serviceAccount string
+	readySince     time.Time
+	refs           int
+}
+
+// podReadySince is the last transition of the Ready condition of the Pod, zero if it is not ready
+func podReadySince(pod *corev1.Pod) time.Time {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+			return c.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// watchServiceAccounts starts a shared Pod informer, so the ServiceAccounts are read from its lister instead of getting
+// each Pod from the API server in the EndpointSlice watch. Slices with Pods that the informer does not know yet are
+// emitted again, to fn, once it does.
+func watchServiceAccounts(ctx context.Context, m kubernetes.Interface, fn func(watch.EventType, Slice)) *serviceAccounts {
+	factory := informers.NewSharedInformerFactoryWithOptions(m, 0, informers.WithNamespace(Namespace()))
+	pods := factory.Core().V1().Pods()
+	s := &serviceAccounts{pods: pods.Lister().Pods(Namespace())}
+	added := func(obj interface{}) {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			for _, slice := range s.added(pod) {
+				fn(watch.Modified, slice)
+			}
+		}
+	}
+	pods.Informer().AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    added,
+		UpdateFunc: func(_, obj interface{}) { added(obj) },
+	})
+	factory.Start(ctx.Done())
+	// a single list of the Pods, so the first slices are resolved
+	factory.WaitForCacheSync(ctx.Done())
+	return s
+}
+
+// resolve the ServiceAccounts of the endpoints of the slice. The accounts are kept while any slice refers to their Pod,
+// as a Pod can be deleted before the slices are updated.
+func (s *serviceAccounts) resolve(t watch.EventType, slice *Slice) {
+	s.Lock()
+	defer s.Unlock()
+	if s.accounts == nil {
+		s.accounts = make(map[string]*podAccount)
+		s.slices = make(map[string]Slice)
+	}
+	current := map[string]bool{}
+	if t != watch.Deleted {
+		for i := range slice.Endpoints {
+			e := &slice.Endpoints[i]
+			if e.Pod == "" {
+				continue
+			}
+			account, has := s.accounts[e.Pod]
+			if !has {
+				account = &podAccount{}
+				s.accounts[e.Pod] = account
+			}
+			if !current[e.Pod] {
+				current[e.Pod] = true
+				account.refs++
+			}
+			if account.serviceAccount == "" {
+				if pod, err := s.pods.Get(e.Pod); err == nil {
+					account.serviceAccount = pod.Spec.ServiceAccountName
+					account.readySince = podReadySince(pod)
+				} else {
+					zap.L().Debug("ServiceAccount not resolved yet", zap.String("pod", e.Pod), zap.Error(err))
+				}
+			}
+			e.ServiceAccount = account.serviceAccount
+			if !account.readySince.IsZero() {
+				e.ReadySince = account.readySince
+			}
+		}
+	}
+	// release the pods that the previous version of the slice referred to
+	for _, pod := range slicePods(s.slices[slice.Name]) {
+		if account, has := s.accounts[pod]; has {
+			account.refs--
+			if account.refs <= 0 {
+				delete(s.accounts, pod)
+			}
+		}
+	}
+	if t == watch.Deleted {
+		delete(s.slices, slice.Name)
+	} else {
+		s.slices[slice.Name] = *slice
+	}
+}
+
+// added resolves the ServiceAccount and Ready time of the Pod, it returns the slices that refer to it without these yet
+func (s *serviceAccounts) added(pod *corev1.Pod) []Slice {
+	s.Lock()
+	defer s.Unlock()
+	account, referred := s.accounts[pod.Name]
+	readySince := podReadySince(pod)
+	if !referred || account.serviceAccount == pod.Spec.ServiceAccountName && (readySince.IsZero() || account.readySince.Equal(readySince)) {
+		return nil
+	}
+	account.serviceAccount = pod.Spec.ServiceAccountName
+	if !readySince.IsZero() {
+		account.readySince = readySince
+	}
+	var changed []Slice
+	for name, slice := range s.slices {
+		updated := false
+		endpoints := append([]Endpoint(nil), slice.Endpoints...)
+		for i := range endpoints {
+			if endpoints[i].Pod == pod.Name {
+				endpoints[i].ServiceAccount = account.serviceAccount
+				if !account.readySince.IsZero() {
+					endpoints[i].ReadySince = account.readySince
+				}
+				updated = true
+			}
+		}
+		if updated {
+			slice.Endpoints = endpoints
+			s.slices[name] = slice
+			changed = append(changed, slice)
+		}
+	}
+	return changed
+}
+
+// slicePods are the distinct pods of the endpoints of the slice
+func slicePods(slice Slice) []string {
+	var pods []string
+	for _, e := range slice.Endpoints {
+		if e.Pod != "" && !Contains(pods, e.Pod) {
+			pods = append(pods, e.Pod)
+		}
+	}
+	return pods
+}
+
 // Lists available API's in the Kubernetes API
 func readyz(m *kubernetes.Clientset) (err error) {
 	var payload []byte
@@ -163,7 +337,20 @@ func paths(m *kubernetes.Clientset) (paths Paths, err error) {
 
 var kubeFlagSet = flag.NewFlagSet("kube", flag.ExitOnError)
 
+var (
+	clientOnce sync.Once
+	clientset  *kubernetes.Clientset
+)
+
+// client is shared by the watches, the kubeconfig flag can only be parsed once
 func client() *kubernetes.Clientset {
+	clientOnce.Do(func() {
+		clientset = newClient()
+	})
+	return clientset
+}
+
+func newClient() *kubernetes.Clientset {
 	var kubeconfig *string
 	var defaultLocation string
 	if home := homedir.HomeDir(); home != "" {
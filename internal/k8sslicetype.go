@@ -1,18 +1,23 @@
 package internal
 
 import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/discovery/v1"
 	"k8s.io/api/discovery/v1beta1"
 )
 
 func (slice *Slice) FromV1Beta1(es *v1beta1.EndpointSlice) {
 	slice.Name = es.GetName()
+	slice.Namespace = es.GetNamespace()
 	slice.Service = es.GetLabels()["kubernetes.io/service-name"]
 	slice.AddressType = string(es.AddressType)
 	slice.Endpoints = make([]Endpoint, len(es.Endpoints))
 	slice.Ports = make([]Port, len(es.Ports))
 	for i, e := range es.Endpoints {
-		slice.Endpoints[i].FromK8s(e.Addresses, e.Conditions.Ready, e.Hostname, nil, nil)
+		slice.Endpoints[i].FromK8s(e.Addresses, e.Conditions.Ready, e.Hostname, nil, nil, e.TargetRef)
+		slice.Endpoints[i].ReadySince = es.CreationTimestamp.Time
 		slice.Endpoints[i].Topology.Host = e.Topology["kubernetes.io/hostname"]
 		slice.Endpoints[i].Topology.Zone = e.Topology["topology.kubernetes.io/zone"]
 	}
@@ -23,12 +28,17 @@ func (slice *Slice) FromV1Beta1(es *v1beta1.EndpointSlice) {
 
 func (slice *Slice) FromV1(es *v1.EndpointSlice) {
 	slice.Name = es.GetName()
+	slice.Namespace = es.GetNamespace()
 	slice.Service = es.GetLabels()["kubernetes.io/service-name"]
 	slice.AddressType = string(es.AddressType)
 	slice.Endpoints = make([]Endpoint, len(es.Endpoints))
 	slice.Ports = make([]Port, len(es.Ports))
 	for i, e := range es.Endpoints {
-		slice.Endpoints[i].FromK8s(e.Addresses, e.Conditions.Ready, e.Hostname, e.NodeName, e.Zone)
+		slice.Endpoints[i].FromK8s(e.Addresses, e.Conditions.Ready, e.Hostname, e.NodeName, e.Zone, e.TargetRef)
+		slice.Endpoints[i].ReadySince = es.CreationTimestamp.Time
+		if e.Conditions.Terminating != nil {
+			slice.Endpoints[i].Terminating = *e.Conditions.Terminating
+		}
 	}
 	for i, p := range es.Ports {
 		slice.Ports[i].FromK8s(p.Name, p.Port, (*string)(p.Protocol))
@@ -37,19 +47,27 @@ func (slice *Slice) FromV1(es *v1.EndpointSlice) {
 
 type Slice struct {
 	Name        string
+	Namespace   string
 	Service     string
 	AddressType string // IPv4 IPv6
 	Endpoints   []Endpoint
 	Ports       []Port
 }
 type Endpoint struct {
-	Addresses  []string
-	Ready      bool
-	TargetName string
-	Topology   Topology
+	Addresses []string
+	Ready     bool
+	// Terminating is only reported by discovery.k8s.io/v1
+	Terminating bool
+	TargetName  string
+	Topology    Topology
+	Pod         string
+	// ServiceAccount of the Pod, resolved by KubernetesEndpointWatch
+	ServiceAccount string
+	// ReadySince is when the Pod became ready, resolved by KubernetesEndpointWatch, else when the slice was created
+	ReadySince time.Time
 }
 
-func (e *Endpoint) FromK8s(addr []string, ready *bool, targetName *string, host *string, zone *string) {
+func (e *Endpoint) FromK8s(addr []string, ready *bool, targetName *string, host *string, zone *string, targetRef *corev1.ObjectReference) {
 	e.Addresses = addr
 	if ready != nil {
 		e.Ready = *ready
@@ -63,6 +81,38 @@ func (e *Endpoint) FromK8s(addr []string, ready *bool, targetName *string, host
 	if zone != nil {
 		e.Topology.Zone = *zone
 	}
+	if targetRef != nil && targetRef.Kind == "Pod" {
+		e.Pod = targetRef.Name
+	}
+}
+
+// ServiceInfo is the part of a Kubernetes Service that the EndpointSlices do not tell: its virtual IP, or the DNS name
+// that ExternalName services alias
+type ServiceInfo struct {
+	Name         string
+	Namespace    string
+	ClusterIP    string // empty or None for headless services
+	ExternalName string
+	Ports        []Port
+	// Affinity by the annotations or sessionAffinity of the Service
+	Affinity *AffinityConfig
+}
+
+func (info *ServiceInfo) FromV1(svc *corev1.Service) {
+	info.Name = svc.GetName()
+	info.Namespace = svc.GetNamespace()
+	if svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		info.ClusterIP = svc.Spec.ClusterIP
+	}
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		info.ExternalName = svc.Spec.ExternalName
+	}
+	info.Affinity = affinityFromService(svc.GetAnnotations(), svc.Spec.SessionAffinity == corev1.ServiceAffinityClientIP)
+	info.Ports = make([]Port, len(svc.Spec.Ports))
+	for i, p := range svc.Spec.Ports {
+		protocol := string(p.Protocol)
+		info.Ports[i].FromK8s(&svc.Spec.Ports[i].Name, &svc.Spec.Ports[i].Port, &protocol)
+	}
 }
 
 type Topology struct {
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	roundrobin "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/round_robin/v3"
+	wrrlocality "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/wrr_locality/v3"
+	// go-control-plane has the ClientSideWeightedRoundRobin type from v0.11, which requires a newer gRPC
+	wrr "github.com/hermanbanken/k8s-xds/pkg/gen/envoy/extensions/load_balancing_policies/client_side_weighted_round_robin/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// WeightedRoundRobinConfig makes clients weigh the endpoints by the load they report with ORCA (gRPC A58): endpoints
+// that serve fewer queries per second per unit of CPU utilization get less traffic.
+// Zero values use the defaults of the clients.
+type WeightedRoundRobinConfig struct {
+	// OobReportingPeriod enables out of band load reports at this period, instead of reports in the trailers of calls
+	OobReportingPeriod time.Duration `mapstructure:"oobReportingPeriod"`
+	// BlackoutPeriod ignores the weights of new endpoints (or endpoints whose weights expired) for this period
+	BlackoutPeriod time.Duration `mapstructure:"blackoutPeriod"`
+	// WeightExpirationPeriod expires weights that are not updated by reports
+	WeightExpirationPeriod time.Duration `mapstructure:"weightExpirationPeriod"`
+	WeightUpdatePeriod     time.Duration `mapstructure:"weightUpdatePeriod"`
+	// ErrorUtilizationPenalty increases the utilization of endpoints by their errors per query
+	ErrorUtilizationPenalty float32 `mapstructure:"errorUtilizationPenalty"`
+}
+
+// loadBalancingPolicy prefers weighted round robin within the (weighted) localities, as gRPC does, then weighted round
+// robin only, as Envoy does, and falls back to round robin for clients that support neither. Clients that do not support
+// load_balancing_policy at all, like gRPC 1.46, use the lb_policy of the cluster. Round robin starts new endpoints slowly
+// with a slowStart config.
+func loadBalancingPolicy(cfg *WeightedRoundRobinConfig, slowStart *cluster.Cluster_SlowStartConfig) *cluster.LoadBalancingPolicy {
+	if cfg == nil {
+		return nil
+	}
+	weighted := policy("envoy.load_balancing_policies.client_side_weighted_round_robin", any(cfg.message()))
+	roundRobin := policy("envoy.load_balancing_policies.round_robin", any(&roundrobin.RoundRobin{SlowStartConfig: slowStart}))
+	locality := policy("envoy.load_balancing_policies.wrr_locality", any(&wrrlocality.WrrLocality{
+		EndpointPickingPolicy: &cluster.LoadBalancingPolicy{Policies: []*cluster.LoadBalancingPolicy_Policy{weighted, roundRobin}},
+	}))
+	return &cluster.LoadBalancingPolicy{Policies: []*cluster.LoadBalancingPolicy_Policy{locality, weighted, roundRobin}}
+}
+
+func policy(name string, config *anypb.Any) *cluster.LoadBalancingPolicy_Policy {
+	return &cluster.LoadBalancingPolicy_Policy{TypedExtensionConfig: &core.TypedExtensionConfig{Name: name, TypedConfig: config}}
+}
+
+// message of the config, the fields the clients default are left unset
+func (cfg WeightedRoundRobinConfig) message() *wrr.ClientSideWeightedRoundRobin {
+	m := &wrr.ClientSideWeightedRoundRobin{}
+	if cfg.OobReportingPeriod > 0 {
+		m.EnableOobLoadReport = wrapperspb.Bool(true)
+		m.OobReportingPeriod = duration(cfg.OobReportingPeriod)
+	}
+	if cfg.BlackoutPeriod > 0 {
+		m.BlackoutPeriod = duration(cfg.BlackoutPeriod)
+	}
+	if cfg.WeightExpirationPeriod > 0 {
+		m.WeightExpirationPeriod = duration(cfg.WeightExpirationPeriod)
+	}
+	if cfg.WeightUpdatePeriod > 0 {
+		m.WeightUpdatePeriod = duration(cfg.WeightUpdatePeriod)
+	}
+	if cfg.ErrorUtilizationPenalty > 0 {
+		m.ErrorUtilizationPenalty = wrapperspb.Float(cfg.ErrorUtilizationPenalty)
+	}
+	return m
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	wrrlocality "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/wrr_locality/v3"
+	wrr "github.com/hermanbanken/k8s-xds/pkg/gen/envoy/extensions/load_balancing_policies/client_side_weighted_round_robin/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	config := viper.New()
+	config.Set("services", map[string]interface{}{
+		"example-server": map[string]interface{}{
+			"weightedRoundRobin": map[string]interface{}{"oobReportingPeriod": "10s", "blackoutPeriod": "5s"},
+		},
+	})
+	services, err := ReadServices(config)
+	assert.NoError(t, err)
+
+	c := createCluster("example-server-cluster", "example-server-cluster", nil, services["example-server"], nil)[0].(*cluster.Cluster)
+	// clients without load_balancing_policy support keep using round robin
+	assert.Equal(t, cluster.Cluster_ROUND_ROBIN, c.LbPolicy)
+	policies := c.LoadBalancingPolicy.Policies
+	assert.Equal(t, []string{"envoy.load_balancing_policies.wrr_locality", "envoy.load_balancing_policies.client_side_weighted_round_robin", "envoy.load_balancing_policies.round_robin"},
+		[]string{policies[0].TypedExtensionConfig.Name, policies[1].TypedExtensionConfig.Name, policies[2].TypedExtensionConfig.Name})
+	locality := &wrrlocality.WrrLocality{}
+	assert.NoError(t, policies[0].TypedExtensionConfig.TypedConfig.UnmarshalTo(locality))
+	assert.True(t, proto.Equal(policies[1], locality.EndpointPickingPolicy.Policies[0]))
+
+	weighted := &wrr.ClientSideWeightedRoundRobin{}
+	assert.Equal(t, "type.googleapis.com/envoy.extensions.load_balancing_policies.client_side_weighted_round_robin.v3.ClientSideWeightedRoundRobin",
+		policies[1].TypedExtensionConfig.TypedConfig.TypeUrl)
+	assert.NoError(t, policies[1].TypedExtensionConfig.TypedConfig.UnmarshalTo(weighted))
+	assert.True(t, weighted.EnableOobLoadReport.GetValue())
+	assert.Equal(t, 10*time.Second, weighted.OobReportingPeriod.AsDuration())
+	assert.Equal(t, 5*time.Second, weighted.BlackoutPeriod.AsDuration())
+	assert.Nil(t, weighted.WeightUpdatePeriod)
+
+	c = createCluster("other-cluster", "other-cluster", nil, ServiceConfig{}, nil)[0].(*cluster.Cluster)
+	assert.Nil(t, c.LoadBalancingPolicy)
+}
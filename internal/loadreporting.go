@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	lrs "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// loadIdleReports is the number of report intervals after which the loads of an endpoint without requests are dropped
+const loadIdleReports = 10
+
+// Reported loads per cluster/source zone/zone, served by the admin server at /debug/vars
+func init() {
+	expvar.Publish("load_successful_requests", loadMetric(func(l Load) uint64 { return l.Successful }))
+	expvar.Publish("load_error_requests", loadMetric(func(l Load) uint64 { return l.Errors }))
+	expvar.Publish("load_issued_requests", loadMetric(func(l Load) uint64 { return l.Issued }))
+}
+
+// publishedLoads is the server of which the loads are published as expvars
+var publishedLoads struct {
+	sync.Mutex
+	server *LoadReportingServer
+}
+
+// publishLoads publishes the loads of the server as expvars, instead of the loads of a previous server
+func publishLoads(s *LoadReportingServer) {
+	publishedLoads.Lock()
+	defer publishedLoads.Unlock()
+	publishedLoads.server = s
+}
+
+// loadMetric sums the value of the loads per cluster/source zone/zone, so it only has the loads that are not dropped
+func loadMetric(value func(Load) uint64) expvar.Func {
+	return func() interface{} {
+		publishedLoads.Lock()
+		s := publishedLoads.server
+		publishedLoads.Unlock()
+		metric := map[string]uint64{}
+		if s == nil {
+			return metric
+		}
+		for _, load := range s.Loads() {
+			metric[fmt.Sprintf("%s/%s/%s", load.Cluster, load.SourceZone, load.Zone)] += value(load)
+		}
+		return metric
+	}
+}
+
+// Load are the requests that the clients in SourceZone sent to the Zone (and Endpoint) of the Cluster
+type Load struct {
+	Cluster    string `json:"cluster"`
+	SourceZone string `json:"sourceZone"`
+	Zone       string `json:"zone"`
+	// Endpoint is only reported by Envoy, gRPC (1.46) reports per locality
+	Endpoint   string `json:"endpoint,omitempty"`
+	Successful uint64 `json:"successful"`
+	Errors     uint64 `json:"errors"`
+	// Issued is not reported by gRPC (1.46)
+	Issued uint64 `json:"issued"`
+}
+
+// activeLoad is a Load with when its last requests were reported, see prune
+type activeLoad struct {
+	Load
+	active time.Time
+}
+
+type loadKey struct {
+	cluster, sourceZone, zone, endpoint string
+}
+
+// LoadReportingServer aggregates the loads that the clients report (LRS) in memory, so we can see where the clients
+// actually send their requests, e.g. to confirm that they prefer their own zone
+type LoadReportingServer struct {
+	// Interval at which the clients report their loads
+	Interval time.Duration
+
+	mu    sync.Mutex
+	loads map[loadKey]*activeLoad
+}
+
+// StreamLoadStats receives the loads of a client, which reports the requests since its previous report
+func (s *LoadReportingServer) StreamLoadStats(stream lrs.LoadReportingService_StreamLoadStatsServer) error {
+	var node *core.Node
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if node == nil {
+			node = req.GetNode()
+			if node == nil {
+				node = &core.Node{}
+			}
+			err := stream.Send(&lrs.LoadStatsResponse{
+				SendAllClusters:       true,
+				LoadReportingInterval: durationpb.New(s.Interval),
+				// gRPC (1.46) fails on requests for endpoint loads
+				ReportEndpointGranularity: isEnvoy(node),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		s.report(node.GetLocality().GetZone(), req.GetClusterStats(), time.Now())
+	}
+}
+
+func (s *LoadReportingServer) report(sourceZone string, stats []*endpoint.ClusterStats, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loads == nil {
+		s.loads = make(map[loadKey]*activeLoad)
+	}
+	for _, cluster := range stats {
+		for _, locality := range cluster.GetUpstreamLocalityStats() {
+			zone := locality.GetLocality().GetZone()
+			if len(locality.GetUpstreamEndpointStats()) == 0 {
+				s.add(loadKey{cluster.GetClusterName(), sourceZone, zone, ""}, locality.GetTotalSuccessfulRequests(), locality.GetTotalErrorRequests(), locality.GetTotalIssuedRequests(), now)
+				continue
+			}
+			for _, e := range locality.GetUpstreamEndpointStats() {
+				s.add(loadKey{cluster.GetClusterName(), sourceZone, zone, endpointAddress(e.GetAddress())}, e.GetTotalSuccessfulRequests(), e.GetTotalErrorRequests(), e.GetTotalIssuedRequests(), now)
+			}
+		}
+	}
+	s.prune(now)
+}
+
+func (s *LoadReportingServer) add(key loadKey, successful, errors, issued uint64, now time.Time) {
+	if successful+errors+issued == 0 {
+		return
+	}
+	load, has := s.loads[key]
+	if !has {
+		load = &activeLoad{Load: Load{Cluster: key.cluster, SourceZone: key.sourceZone, Zone: key.zone, Endpoint: key.endpoint}}
+		s.loads[key] = load
+	}
+	load.Successful += successful
+	load.Errors += errors
+	load.Issued += issued
+	load.active = now
+}
+
+// prune drops the loads that got no requests for loadIdleReports intervals, e.g. of endpoints that are gone, so the
+// loads do not grow with every endpoint ever reported
+func (s *LoadReportingServer) prune(now time.Time) {
+	if s.Interval <= 0 {
+		return
+	}
+	for key, load := range s.loads {
+		if now.Sub(load.active) > loadIdleReports*s.Interval {
+			delete(s.loads, key)
+		}
+	}
+}
+
+func endpointAddress(address *core.Address) string {
+	socket := address.GetSocketAddress()
+	if socket == nil {
+		return ""
+	}
+	return net.JoinHostPort(socket.GetAddress(), fmt.Sprint(socket.GetPortValue()))
+}
+
+// Loads lists the loads reported since the start of the control plane, of the endpoints that are not idle
+func (s *LoadReportingServer) Loads() []Load {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loads := make([]Load, 0, len(s.loads))
+	for _, load := range s.loads {
+		loads = append(loads, load.Load)
+	}
+	sort.Slice(loads, func(i, j int) bool {
+		a, b := loads[i], loads[j]
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		if a.SourceZone != b.SourceZone {
+			return a.SourceZone < b.SourceZone
+		}
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		return a.Endpoint < b.Endpoint
+	})
+	return loads
+}
+
+// ServeHTTP implements the admin API for the reported loads
+func (s *LoadReportingServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, http.StatusOK, s.Loads())
+}
+
+// selfConfigSource makes the clients report their loads over the connection of their xDS stream
+func selfConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ResourceApiVersion:    core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Self{Self: &core.SelfConfigSource{}},
+	}
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	examplev1 "github.com/hermanbanken/k8s-xds/example/pkg/gen/v1"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/xds"
+)
+
+func TestLoadReportingAggregates(t *testing.T) {
+	s := &LoadReportingServer{}
+	address := &core.Address{Address: &core.Address_SocketAddress{SocketAddress: &core.SocketAddress{Address: "10.0.0.1", PortSpecifier: &core.SocketAddress_PortValue{PortValue: 8080}}}}
+	stats := []*endpoint.ClusterStats{{
+		ClusterName: "a-cluster",
+		UpstreamLocalityStats: []*endpoint.UpstreamLocalityStats{
+			{Locality: &core.Locality{Zone: "europe-west4-a"}, TotalSuccessfulRequests: 9, TotalErrorRequests: 1, TotalIssuedRequests: 10},
+			// Envoy reports per endpoint
+			{Locality: &core.Locality{Zone: "europe-west4-b"}, UpstreamEndpointStats: []*endpoint.UpstreamEndpointStats{
+				{Address: address, TotalSuccessfulRequests: 2, TotalIssuedRequests: 2},
+			}},
+		},
+	}}
+	// the reports are the requests since the previous report
+	now := time.Now()
+	s.report("europe-west4-a", stats, now)
+	s.report("europe-west4-a", stats, now)
+	assert.Equal(t, []Load{
+		{Cluster: "a-cluster", SourceZone: "europe-west4-a", Zone: "europe-west4-a", Successful: 18, Errors: 2, Issued: 20},
+		{Cluster: "a-cluster", SourceZone: "europe-west4-a", Zone: "europe-west4-b", Endpoint: "10.0.0.1:8080", Successful: 4, Issued: 4},
+	}, s.Loads())
+}
+
+func TestLoadReportingPrunesIdle(t *testing.T) {
+	s := &LoadReportingServer{Interval: time.Second}
+	publishLoads(s)
+	defer publishLoads(nil)
+	stats := func(zone string, successful uint64) []*endpoint.ClusterStats {
+		return []*endpoint.ClusterStats{{ClusterName: "a-cluster", UpstreamLocalityStats: []*endpoint.UpstreamLocalityStats{
+			{Locality: &core.Locality{Zone: zone}, TotalSuccessfulRequests: successful},
+		}}}
+	}
+	now := time.Now()
+	s.report("europe-west4-a", stats("europe-west4-a", 1), now)
+	s.report("europe-west4-a", stats("europe-west4-b", 1), now)
+	assert.Equal(t, map[string]uint64{"a-cluster/europe-west4-a/europe-west4-a": 1, "a-cluster/europe-west4-a/europe-west4-b": 1}, expvar.Get("load_successful_requests").(expvar.Func).Value())
+
+	// the zone without requests is dropped after 10 intervals, from the metrics too
+	for i := 1; i <= loadIdleReports+1; i++ {
+		s.report("europe-west4-a", stats("europe-west4-a", 1), now.Add(time.Duration(i)*time.Second))
+		s.report("europe-west4-a", stats("europe-west4-b", 0), now.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, []Load{{Cluster: "a-cluster", SourceZone: "europe-west4-a", Zone: "europe-west4-a", Successful: 12}}, s.Loads())
+	assert.Equal(t, map[string]uint64{"a-cluster/europe-west4-a/europe-west4-a": 12}, expvar.Get("load_successful_requests").(expvar.Func).Value())
+}
+
+// TestXdsLoadReporting confirms with the reported loads that clients prefer the endpoints in their own zone
+func TestXdsLoadReporting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	go runServer(8180)
+	go runServer(8181)
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9180)
+	config.Set("managementServer.loadReportingInterval", "100ms")
+	config.Set("admin.port", 9181)
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"example-server": {
+		"europe-west4-a": {{IP: "127.0.0.1", Port: 8180, Zone: "europe-west4-a"}},
+		"europe-west4-b": {{IP: "127.0.0.1", Port: 8181, Zone: "europe-west4-b"}},
+	}})
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting([]byte(`{
+  "xds_servers": [{"server_uri": "localhost:9180", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "node": {"id": "reporting-client", "locality": {"zone": "europe-west4-a"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := grpc.DialContext(ctx, "xds:///example-server", grpc.WithInsecure(), grpc.WithResolvers(resolver))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	// until the own zone is connected, calls can go to the other zone
+	successful := uint64(0)
+	if !assert.Eventually(t, func() bool {
+		resp, err := examplev1.NewExampleClient(c).DoSomething(ctx, &examplev1.ExampleRequest{Name: "hello world"})
+		if err != nil {
+			return false
+		}
+		successful++
+		return resp.Message == "Hi hello world from 8180"
+	}, 10*time.Second, 10*time.Millisecond) {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "Hi hello world from 8180", runClient(ctx, c))
+	}
+	successful += 10
+
+	// the clients report every 100ms, so poll until all calls are reported
+	var loads []Load
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if loads = getLoads(t, "http://localhost:9181/loads"); totalSuccessful(loads) >= successful {
+			break
+		}
+	}
+	assert.Equal(t, successful, totalSuccessful(loads))
+	var own Load
+	for _, load := range loads {
+		if load.Zone == "europe-west4-a" {
+			own = load
+		}
+	}
+	// gRPC (1.46) does not report the issued requests
+	assert.Equal(t, Load{Cluster: "example-server-cluster", SourceZone: "europe-west4-a", Zone: "europe-west4-a", Successful: own.Successful}, own)
+	assert.GreaterOrEqual(t, own.Successful, uint64(11))
+}
+
+func getLoads(t *testing.T, url string) []Load {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	var loads []Load
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&loads))
+	return loads
+}
+
+func totalSuccessful(loads []Load) uint64 {
+	total := uint64(0)
+	for _, load := range loads {
+		total += load.Successful
+	}
+	return total
+}
@@ -11,6 +11,7 @@ import (
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
 	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	lrsservice "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
 	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
 	runtimeservice "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
 	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
@@ -32,8 +33,9 @@ func registerServices(grpcServer *grpc.Server, server xds.Server) {
 	runtimeservice.RegisterRuntimeDiscoveryServiceServer(grpcServer, server)
 }
 
-// RunManagementServer starts an xDS server at the given port.
-func RunManagementServer(ctx context.Context, server xds.Server, port uint, maxConcurrentStreams uint32) {
+// RunManagementServer starts an xDS server at the given port, which also answers the route lookups of the clients, and
+// receives their load reports when loads is set.
+func RunManagementServer(ctx context.Context, server xds.Server, lookup *RouteLookupServer, loads *LoadReportingServer, port uint, maxConcurrentStreams uint32) {
 	var grpcOptions []grpc.ServerOption
 	grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(maxConcurrentStreams))
 	grpcServer := grpc.NewServer(grpcOptions...)
@@ -45,6 +47,10 @@ func RunManagementServer(ctx context.Context, server xds.Server, port uint, maxC
 
 	// register services
 	registerServices(grpcServer, server)
+	registerRouteLookupService(grpcServer, lookup)
+	if loads != nil {
+		lrsservice.RegisterLoadReportingServiceServer(grpcServer, loads)
+	}
 
 	zap.L().Info("Management server listening", zap.Uint("port", port))
 	go func() {
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// defaultIdempotentRetries are the retries of the methods that are marked idempotent in their descriptors
+const defaultIdempotentRetries = 2
+
+// defaultRetryOn are the status codes on which the calls are retried
+var defaultRetryOn = []string{"unavailable"}
+
+// MethodConfig is the policy of the calls to a method of a service
+type MethodConfig struct {
+	// Name of the method, like example.v1.Example/DoSomething
+	Name string `mapstructure:"name"`
+	// Timeout of the calls, "0s" disables it. Streaming methods have no timeout by default, unary methods that of the client.
+	Timeout *time.Duration `mapstructure:"timeout"`
+	// Retries of the calls that fail with a status in RetryOn. Idempotent methods are retried twice by default.
+	Retries *uint32 `mapstructure:"retries"`
+	// RetryOn are the statuses that are retried, like unavailable (default), resource-exhausted or cancelled
+	RetryOn []string `mapstructure:"retryOn"`
+}
+
+// path of the method in the calls, like /example.v1.Example/DoSomething
+func (m MethodConfig) path() string {
+	return "/" + strings.TrimPrefix(m.Name, "/")
+}
+
+// useOn sets the policy on the action of the route of the method
+func (m MethodConfig) useOn(action *route.RouteAction) {
+	if m.Timeout != nil {
+		// Envoy uses the timeout, gRPC (A31) the max stream duration; a zero duration disables both
+		action.Timeout = durationpb.New(*m.Timeout)
+		action.MaxStreamDuration = &route.RouteAction_MaxStreamDuration{MaxStreamDuration: durationpb.New(*m.Timeout)}
+	}
+	if m.Retries != nil && *m.Retries > 0 {
+		retryOn := m.RetryOn
+		if len(retryOn) == 0 {
+			retryOn = defaultRetryOn
+		}
+		action.RetryPolicy = &route.RetryPolicy{
+			RetryOn:    strings.Join(retryOn, ","),
+			NumRetries: wrapperspb.UInt32(*m.Retries),
+		}
+	}
+}
+
+// Descriptors are the protobuf files of the gRPC services, read from compiled FileDescriptorSets
+type Descriptors struct {
+	files *protoregistry.Files
+}
+
+// ReadDescriptors reads the FileDescriptorSets (like those of `buf build -o` or `protoc --descriptor_set_out
+// --include_imports`) of the `descriptors` config key, it returns nil when none are configured
+func ReadDescriptors(config *viper.Viper) (*Descriptors, error) {
+	paths := config.GetStringSlice("descriptors")
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(data, files); err != nil {
+			return nil, fmt.Errorf("descriptors %s: %w", path, err)
+		}
+		// the sets of several services can include the same imports
+		for _, file := range files.File {
+			if !seen[file.GetName()] {
+				seen[file.GetName()] = true
+				set.File = append(set.File, file)
+			}
+		}
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	return &Descriptors{files: files}, nil
+}
+
+// methods of the gRPC service with their default policies: streaming methods have no timeout, idempotent methods
+// (the idempotency_level option) are retried
+func (d *Descriptors) methods(grpcService string) ([]MethodConfig, error) {
+	if d == nil {
+		return nil, fmt.Errorf("no descriptors of gRPC service %s", grpcService)
+	}
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(grpcService))
+	if err != nil {
+		return nil, fmt.Errorf("gRPC service %s: %w", grpcService, err)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a gRPC service", grpcService)
+	}
+	methods := make([]MethodConfig, 0, service.Methods().Len())
+	for i := 0; i < service.Methods().Len(); i++ {
+		method := service.Methods().Get(i)
+		m := MethodConfig{Name: fmt.Sprintf("%s/%s", service.FullName(), method.Name())}
+		if method.IsStreamingClient() || method.IsStreamingServer() {
+			var none time.Duration
+			m.Timeout = &none
+		}
+		switch method.Options().(*descriptorpb.MethodOptions).GetIdempotencyLevel() {
+		case descriptorpb.MethodOptions_IDEMPOTENT, descriptorpb.MethodOptions_NO_SIDE_EFFECTS:
+			retries := uint32(defaultIdempotentRetries)
+			m.Retries = &retries
+		}
+		methods = append(methods, m)
+	}
+	return methods, nil
+}
+
+// methodRoutes are the methods of the service that get their own routes: those of its gRPC services in the descriptors,
+// with the configured policies on top
+func methodRoutes(cfg ServiceConfig, descriptors *Descriptors) ([]MethodConfig, error) {
+	byPath := map[string]MethodConfig{}
+	for _, grpcService := range cfg.GrpcServices {
+		methods, err := descriptors.methods(grpcService)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range methods {
+			byPath[m.path()] = m
+		}
+	}
+	for _, m := range cfg.Methods {
+		merged := byPath[m.path()]
+		merged.Name = m.Name
+		if m.Timeout != nil {
+			merged.Timeout = m.Timeout
+		}
+		if m.Retries != nil {
+			merged.Retries = m.Retries
+		}
+		if len(m.RetryOn) > 0 {
+			merged.RetryOn = m.RetryOn
+		}
+		byPath[m.path()] = merged
+	}
+	methods := make([]MethodConfig, 0, len(byPath))
+	for _, m := range byPath {
+		methods = append(methods, m)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].path() < methods[j].path() })
+	return methods, nil
+}
+
+// useMethodRoutes puts routes per method ahead of the routes of the virtual host, with the actions of its catch-all
+// routes: the route lookup, when used, and the fallback that clients without route lookup take
+func useMethodRoutes(vh *route.VirtualHost, methods []MethodConfig) {
+	if len(methods) == 0 {
+		return
+	}
+	catchAll := vh.Routes[len(vh.Routes)-1].Match
+	routes := make([]*route.Route, 0, len(methods)*len(vh.Routes)+len(vh.Routes))
+	for _, m := range methods {
+		for _, original := range vh.Routes {
+			if !proto.Equal(original.Match, catchAll) {
+				continue
+			}
+			r := proto.Clone(original).(*route.Route)
+			r.Match = &route.RouteMatch{PathSpecifier: &route.RouteMatch_Path{Path: m.path()}}
+			m.useOn(r.GetRoute())
+			routes = append(routes, r)
+		}
+	}
+	vh.Routes = append(routes, vh.Routes...)
+}
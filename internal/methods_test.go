@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	examplev1 "github.com/hermanbanken/k8s-xds/example/pkg/gen/v1"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/xds"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// writeDescriptors writes a FileDescriptorSet of the example and a search service, and returns its path
+func writeDescriptors(t *testing.T) string {
+	search := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("search/v1/search.proto"),
+		Package:    proto.String("search.v1"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"v1/example.proto"},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Search"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("Query"), InputType: proto.String(".example.v1.ExampleRequest"), OutputType: proto.String(".example.v1.ExampleResponse"),
+					Options: &descriptorpb.MethodOptions{IdempotencyLevel: descriptorpb.MethodOptions_NO_SIDE_EFFECTS.Enum()}},
+				{Name: proto.String("Watch"), InputType: proto.String(".example.v1.ExampleRequest"), OutputType: proto.String(".example.v1.ExampleResponse"),
+					ServerStreaming: proto.Bool(true)},
+				{Name: proto.String("Index"), InputType: proto.String(".example.v1.ExampleRequest"), OutputType: proto.String(".example.v1.ExampleResponse")},
+			},
+		}},
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(examplev1.File_v1_example_proto), search}}
+	data, err := proto.Marshal(set)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "descriptors.binpb")
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	return path
+}
+
+func TestMethodRoutes(t *testing.T) {
+	config := viper.New()
+	path := writeDescriptors(t)
+	config.Set("descriptors", []string{path, path})
+	config.Set("services", map[string]interface{}{"search": map[string]interface{}{
+		"grpcServices": []string{"search.v1.Search"},
+		"methods": []interface{}{
+			map[string]interface{}{"name": "search.v1.Search/Index", "timeout": "2s"},
+			map[string]interface{}{"name": "/search.v1.Search/Query", "retries": 4, "retryOn": []string{"unavailable", "resource-exhausted"}},
+		},
+	}})
+	descriptors, err := ReadDescriptors(config)
+	assert.NoError(t, err)
+	services, err := ReadServices(config)
+	assert.NoError(t, err)
+
+	methods, err := methodRoutes(services["search"], descriptors)
+	assert.NoError(t, err)
+	var paths []string
+	for _, m := range methods {
+		paths = append(paths, m.path())
+	}
+	assert.Equal(t, []string{"/search.v1.Search/Index", "/search.v1.Search/Query", "/search.v1.Search/Watch"}, paths)
+	assert.Equal(t, 2*time.Second, *methods[0].Timeout)
+	assert.Nil(t, methods[0].Retries)
+	assert.Equal(t, uint32(4), *methods[1].Retries)
+	assert.Equal(t, time.Duration(0), *methods[2].Timeout)
+
+	_, err = methodRoutes(ServiceConfig{GrpcServices: []string{"search.v1.Unknown"}}, descriptors)
+	assert.Error(t, err)
+	_, err = methodRoutes(ServiceConfig{GrpcServices: []string{"search.v1.Search"}}, nil)
+	assert.Error(t, err)
+	assert.Error(t, ServiceConfig{Methods: []MethodConfig{{Name: "Query"}}}.validate())
+
+	mapping := Mapping{"search": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}}
+	opts := Options{Services: services, Descriptors: descriptors}
+	ss, err := GenerateSnapshot(&core.Node{Id: "client"}, mapping, opts)
+	assert.NoError(t, err)
+	routes := ss.GetResources(resource.RouteType)["search-route"].(*route.RouteConfiguration).VirtualHosts[0].Routes
+	assert.Len(t, routes, 4)
+	assert.Equal(t, "/search.v1.Search/Index", routes[0].GetMatch().GetPath())
+	assert.Equal(t, 2*time.Second, routes[0].GetRoute().GetMaxStreamDuration().GetMaxStreamDuration().AsDuration())
+	assert.Equal(t, "unavailable,resource-exhausted", routes[1].GetRoute().GetRetryPolicy().GetRetryOn())
+	assert.Equal(t, uint32(4), routes[1].GetRoute().GetRetryPolicy().GetNumRetries().GetValue())
+	assert.Equal(t, "search-cluster", routes[2].GetRoute().GetCluster())
+	// the catch-all route is last
+	assert.Equal(t, "", routes[3].GetMatch().GetPrefix())
+	assert.Nil(t, routes[3].GetRoute().RetryPolicy)
+
+	// Envoy disables its default timeout for the streaming methods
+	ss, err = GenerateSnapshot(&core.Node{Id: "envoy", UserAgentName: "envoy"}, mapping, opts)
+	assert.NoError(t, err)
+	rc := ss.GetResources(resource.RouteType)["outbound_8080"].(*route.RouteConfiguration)
+	assert.NoError(t, rc.ValidateAll())
+	routes = rc.VirtualHosts[0].Routes
+	assert.Equal(t, "/search.v1.Search/Watch", routes[2].GetMatch().GetPath())
+	assert.NotNil(t, routes[2].GetRoute().Timeout)
+	assert.Equal(t, time.Duration(0), routes[2].GetRoute().Timeout.AsDuration())
+}
+
+// flaky fails every other call as unavailable
+type flaky struct {
+	examplev1.UnimplementedExampleServer
+	port  int
+	calls int32
+}
+
+func (f *flaky) DoSomething(ctx context.Context, req *examplev1.ExampleRequest) (*examplev1.ExampleResponse, error) {
+	if atomic.AddInt32(&f.calls, 1)%2 == 1 {
+		return nil, status.Error(codes.Unavailable, "flaky")
+	}
+	return &examplev1.ExampleResponse{Message: fmt.Sprintf("Hi %s from %d", req.Name, f.port)}, nil
+}
+
+// TestXdsMethodRoutes retries the calls to an idempotent method
+func TestXdsMethodRoutes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	go func() {
+		grpcServer := grpc.NewServer()
+		examplev1.RegisterExampleServer(grpcServer, &flaky{port: 8160})
+		lis, err := net.Listen("tcp", ":8160")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		grpcServer.Serve(lis)
+	}()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9160)
+	config.Set("descriptors", []string{writeDescriptors(t)})
+	config.Set("services", map[string]interface{}{"search": map[string]interface{}{
+		"grpcServices": []string{"example.v1.Example"},
+		"methods":      []interface{}{map[string]interface{}{"name": "example.v1.Example/DoSomething", "retries": 2}},
+	}})
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"search": {"europe-west4-a": {{IP: "127.0.0.1", Port: 8160, Zone: "europe-west4-a"}}}})
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting([]byte(`{
+  "xds_servers": [{"server_uri": "localhost:9160", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "node": {"id": "methods-client", "locality": {"zone": "europe-west4-a"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := grpc.DialContext(ctx, "xds:///search", grpc.WithInsecure(), grpc.WithResolvers(resolver))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		resp, err := examplev1.NewExampleClient(c).DoSomething(ctx, &examplev1.ExampleRequest{Name: "hello world"}, grpc.WaitForReady(true))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Hi hello world from 8160", resp.Message)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// federationScheme is the scheme of the resource names of xDS federation (gRPC A47)
+const federationScheme = "xdstp://"
+
+// failoverSuffix tells the aggregate clusters apart from the EDS clusters, which end in -cluster. The ids of xdstp names
+// are the service names, so there a path segment is used, which service names cannot contain.
+const (
+	failoverSuffix          = "-failover"
+	federatedFailoverSuffix = "/failover"
+)
+
+// resourceNaming names the resources of a service. Without an authority these are the plain names, like
+// example-server-cluster. With an authority these are xdstp names, like
+// xdstp://k8s-xds.example.com/envoy.config.cluster.v3.Cluster/example-server, with which clients fetch the resources
+// from the control plane of that authority.
+type resourceNaming struct {
+	authority string
+}
+
+// listener is the name of the API listener of a service alias, like example-server.default:9090
+func (n resourceNaming) listener(alias string) string {
+	return n.name(resource.ListenerType, alias, alias)
+}
+
+// inbound is the name of the listener that xDS enabled gRPC servers request for their listening address
+func (n resourceNaming) inbound(address string) string {
+	name := fmt.Sprintf(serverListenerNameTemplate, address)
+	return n.name(resource.ListenerType, name, name)
+}
+
+func (n resourceNaming) route(service string) string {
+	return n.name(resource.RouteType, fmt.Sprintf("%s-route", service), service)
+}
+
+// virtualHost names are not resource names, so they are the same for all authorities
+func (n resourceNaming) virtualHost(service string) string {
+	return fmt.Sprintf("%s-vhost", service)
+}
+
+// domains of the virtual host of the aliases. gRPC (1.46) matches the virtual hosts of an xdstp listener by the name of
+// the listener, instead of the dialed name, so these are included as well.
+func (n resourceNaming) domains(aliases []string) []string {
+	if n.authority == "" {
+		return aliases
+	}
+	domains := append([]string(nil), aliases...)
+	for _, alias := range aliases {
+		domains = append(domains, n.listener(alias))
+	}
+	return domains
+}
+
+func (n resourceNaming) cluster(service string) string {
+	return n.name(resource.ClusterType, fmt.Sprintf("%s-cluster", service), service)
+}
+
+// failover is the name of the aggregate cluster of a service with a Failover list
+func (n resourceNaming) failover(service string) string {
+	return n.name(resource.ClusterType, service+failoverSuffix, service+federatedFailoverSuffix)
+}
+
+// endpoints is the name of the cluster load assignment, plain names share the name of the cluster
+func (n resourceNaming) endpoints(service string) string {
+	return n.name(resource.EndpointType, fmt.Sprintf("%s-cluster", service), service)
+}
+
+func (n resourceNaming) name(typeURL string, plain string, id string) string {
+	if n.authority == "" {
+		return plain
+	}
+	return fmt.Sprintf("%s%s/%s/%s", federationScheme, n.authority, strings.TrimPrefix(typeURL, "type.googleapis.com/"), id)
+}
+
+// federatedID returns the id of an xdstp resource name, like example-server for
+// xdstp://k8s-xds.example.com/envoy.config.cluster.v3.Cluster/example-server
+func federatedID(name string) (id string, federated bool) {
+	if !strings.HasPrefix(name, federationScheme) {
+		return "", false
+	}
+	// authority, type and id; the id may contain slashes
+	parts := strings.SplitN(strings.TrimPrefix(name, federationScheme), "/", 3)
+	if len(parts) < 3 {
+		return "", true
+	}
+	return parts[2], true
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/xds"
+)
+
+// federationEnv enables xDS federation in gRPC (1.46)
+const federationEnv = "GRPC_EXPERIMENTAL_XDS_FEDERATION"
+
+func TestGenerateSnapshotFederation(t *testing.T) {
+	mapping := Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}}
+	subscriptions := &Subscriptions{}
+	assert.NotZero(t, subscriptions.Add(streamKey{id: 1}, resource.ListenerType, []string{"xdstp://west.k8s-xds/envoy.config.listener.v3.Listener/a"}, false))
+	assert.Equal(t, "a", subscribedService(resource.ClusterType, "xdstp://west.k8s-xds/envoy.config.cluster.v3.Cluster/a"))
+	assert.Equal(t, "", subscribedService(resource.ListenerType, "xdstp://west.k8s-xds/envoy.config.listener.v3.Listener/grpc/server?xds.resource.listening_address=0.0.0.0:8080"))
+
+	// only the requested style of names is generated
+	ss, err := GenerateSnapshot(&core.Node{Id: "client"}, mapping, Options{Authority: "west.k8s-xds", Subscriptions: subscriptions})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"xdstp://west.k8s-xds/envoy.config.listener.v3.Listener/a", "xdstp://west.k8s-xds/envoy.config.listener.v3.Listener/a:8080"}, resourceNames(ss.GetResources(resource.ListenerType)))
+	assert.Equal(t, []string{"xdstp://west.k8s-xds/envoy.config.route.v3.RouteConfiguration/a"}, resourceNames(ss.GetResources(resource.RouteType)))
+	assert.Equal(t, []string{"xdstp://west.k8s-xds/envoy.config.endpoint.v3.ClusterLoadAssignment/a"}, resourceNames(ss.GetResources(resource.EndpointType)))
+	c := ss.GetResources(resource.ClusterType)["xdstp://west.k8s-xds/envoy.config.cluster.v3.Cluster/a"].(*cluster.Cluster)
+	assert.Equal(t, "xdstp://west.k8s-xds/envoy.config.endpoint.v3.ClusterLoadAssignment/a", c.EdsClusterConfig.ServiceName)
+	assert.NoError(t, ss.Consistent())
+
+	// both styles, for clients that use the control plane as default server and as authority
+	assert.NotZero(t, subscriptions.Add(streamKey{id: 2}, resource.ListenerType, []string{"a"}, false))
+	ss, err = GenerateSnapshot(&core.Node{Id: "client"}, mapping, Options{Authority: "west.k8s-xds", Subscriptions: subscriptions})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-cluster", "xdstp://west.k8s-xds/envoy.config.cluster.v3.Cluster/a"}, resourceNames(ss.GetResources(resource.ClusterType)))
+	assert.Empty(t, ss.GetResources(resource.ClusterType)["a-cluster"].(*cluster.Cluster).EdsClusterConfig.ServiceName)
+}
+
+// TestXdsFederation dials the control planes of two clusters, each serving its own authority
+func TestXdsFederation(t *testing.T) {
+	if rerunWithEnv(t, federationEnv) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	for i, authority := range []string{"west.k8s-xds", "east.k8s-xds"} {
+		go runServer(8070 + i)
+		config := viper.New()
+		config.Set("maxConcurrentStreams", 1000)
+		config.Set("managementServer.port", 9070+i)
+		config.Set("authority", authority)
+		discovery := &manualDiscovery{}
+		go Run(ctx, config, discovery)
+		discovery.Emit(Mapping{"example-server": {"europe-west4-a": {{IP: "127.0.0.1", Port: int32(8070 + i), Zone: "europe-west4-a"}}}})
+	}
+
+	bootstrap := []byte(`{
+  "xds_servers": [{"server_uri": "localhost:9070", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "authorities": {
+    "west.k8s-xds": {"xds_servers": [{"server_uri": "localhost:9070", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}]},
+    "east.k8s-xds": {"xds_servers": [{"server_uri": "localhost:9071", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}]}
+  },
+  "node": {"id": "federated-client", "locality": {"zone": "europe-west4-a"}}
+}`)
+	resolver, err := xds.NewXDSResolverWithConfigForTesting(bootstrap)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for target, port := range map[string]int{
+		"xds:///example-server":             8070,
+		"xds://west.k8s-xds/example-server": 8070,
+		"xds://east.k8s-xds/example-server": 8071,
+	} {
+		c, err := grpc.DialContext(ctx, target, grpc.WithInsecure(), grpc.WithResolvers(resolver))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, fmt.Sprintf("Hi hello world from %d", port), runClient(ctx, c), target)
+		c.Close()
+	}
+}
+
+// rerunWithEnv runs the test in a process with the environment variable set to true, as gRPC reads its experimental
+// environment variables once. It returns false in that process, which runs the test itself.
+func rerunWithEnv(t *testing.T, env string) bool {
+	if os.Getenv(env) == "true" {
+		return false
+	}
+	cmd := exec.Command(os.Args[0], fmt.Sprintf("-test.run=^%s$", t.Name()), "-test.v")
+	cmd.Env = append(os.Environ(), env+"=true")
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+	return true
+}
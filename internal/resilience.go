@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// CircuitBreakerConfig limits the calls to a service, calls exceeding the limit fail immediately
+type CircuitBreakerConfig struct {
+	// MaxRequests is the maximum number of concurrent calls per client
+	MaxRequests uint32 `mapstructure:"maxRequests"`
+}
+
+// OutlierDetectionConfig makes clients eject hosts that fail more than their peers (gRPC A50).
+// Zero values use the defaults of Envoy and gRPC. An ejection algorithm is only enabled when configured.
+type OutlierDetectionConfig struct {
+	Interval           time.Duration `mapstructure:"interval"`
+	BaseEjectionTime   time.Duration `mapstructure:"baseEjectionTime"`
+	MaxEjectionTime    time.Duration `mapstructure:"maxEjectionTime"`
+	MaxEjectionPercent uint32        `mapstructure:"maxEjectionPercent"`
+	SuccessRate        *struct {
+		// StdevFactor ejects hosts with a success rate below mean - (StdevFactor/1000) * stdev
+		StdevFactor           uint32 `mapstructure:"stdevFactor"`
+		EnforcementPercentage uint32 `mapstructure:"enforcementPercentage"`
+		MinimumHosts          uint32 `mapstructure:"minimumHosts"`
+		RequestVolume         uint32 `mapstructure:"requestVolume"`
+	} `mapstructure:"successRate"`
+	FailurePercentage *struct {
+		// Threshold ejects hosts with a failure percentage above it
+		Threshold             uint32 `mapstructure:"threshold"`
+		EnforcementPercentage uint32 `mapstructure:"enforcementPercentage"`
+		MinimumHosts          uint32 `mapstructure:"minimumHosts"`
+		RequestVolume         uint32 `mapstructure:"requestVolume"`
+	} `mapstructure:"failurePercentage"`
+}
+
+func circuitBreakers(cfg *CircuitBreakerConfig) *cluster.CircuitBreakers {
+	if cfg == nil || cfg.MaxRequests == 0 {
+		return nil
+	}
+	return &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{{
+			Priority:    core.RoutingPriority_DEFAULT,
+			MaxRequests: wrapperspb.UInt32(cfg.MaxRequests),
+		}},
+	}
+}
+
+func outlierDetection(cfg *OutlierDetectionConfig) *cluster.OutlierDetection {
+	if cfg == nil {
+		return nil
+	}
+	od := &cluster.OutlierDetection{
+		Interval:           duration(cfg.Interval),
+		BaseEjectionTime:   duration(cfg.BaseEjectionTime),
+		MaxEjectionTime:    duration(cfg.MaxEjectionTime),
+		MaxEjectionPercent: uint32Value(cfg.MaxEjectionPercent),
+		// gRPC does not support consecutive errors detection, disable it so Envoy behaves the same
+		EnforcingConsecutive_5Xx:           wrapperspb.UInt32(0),
+		EnforcingConsecutiveGatewayFailure: wrapperspb.UInt32(0),
+		EnforcingSuccessRate:               wrapperspb.UInt32(0),
+		EnforcingFailurePercentage:         wrapperspb.UInt32(0),
+	}
+	if sr := cfg.SuccessRate; sr != nil {
+		od.EnforcingSuccessRate = wrapperspb.UInt32(100)
+		if sr.EnforcementPercentage > 0 {
+			od.EnforcingSuccessRate = wrapperspb.UInt32(sr.EnforcementPercentage)
+		}
+		od.SuccessRateStdevFactor = uint32Value(sr.StdevFactor)
+		od.SuccessRateMinimumHosts = uint32Value(sr.MinimumHosts)
+		od.SuccessRateRequestVolume = uint32Value(sr.RequestVolume)
+	}
+	if fp := cfg.FailurePercentage; fp != nil {
+		od.EnforcingFailurePercentage = wrapperspb.UInt32(100)
+		if fp.EnforcementPercentage > 0 {
+			od.EnforcingFailurePercentage = wrapperspb.UInt32(fp.EnforcementPercentage)
+		}
+		od.FailurePercentageThreshold = uint32Value(fp.Threshold)
+		od.FailurePercentageMinimumHosts = uint32Value(fp.MinimumHosts)
+		od.FailurePercentageRequestVolume = uint32Value(fp.RequestVolume)
+	}
+	return od
+}
+
+// duration leaves zero durations unset, so the client uses its default
+func duration(d time.Duration) *durationpb.Duration {
+	if d == 0 {
+		return nil
+	}
+	return durationpb.New(d)
+}
+
+// uint32Value leaves zero values unset, so the client uses its default
+func uint32Value(v uint32) *wrapperspb.UInt32Value {
+	if v == 0 {
+		return nil
+	}
+	return wrapperspb.UInt32(v)
+}
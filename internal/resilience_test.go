@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakingAndOutlierDetection(t *testing.T) {
+	config := viper.New()
+	config.Set("services", map[string]interface{}{
+		"example-server": map[string]interface{}{
+			"circuitBreaker": map[string]interface{}{"maxRequests": 100},
+			"outlierDetection": map[string]interface{}{
+				"interval":          "5s",
+				"baseEjectionTime":  "1m",
+				"failurePercentage": map[string]interface{}{"threshold": 50},
+			},
+		},
+	})
+	services, err := ReadServices(config)
+	assert.NoError(t, err)
+
+	c := createCluster("example-server-cluster", "example-server-cluster", nil, services["example-server"], nil)[0].(*cluster.Cluster)
+	assert.Equal(t, uint32(100), c.CircuitBreakers.Thresholds[0].MaxRequests.GetValue())
+	assert.Equal(t, 5*time.Second, c.OutlierDetection.Interval.AsDuration())
+	assert.Equal(t, time.Minute, c.OutlierDetection.BaseEjectionTime.AsDuration())
+	assert.Nil(t, c.OutlierDetection.MaxEjectionTime)
+	assert.Equal(t, uint32(50), c.OutlierDetection.FailurePercentageThreshold.GetValue())
+	assert.Equal(t, uint32(100), c.OutlierDetection.EnforcingFailurePercentage.GetValue())
+	assert.Equal(t, uint32(0), c.OutlierDetection.EnforcingSuccessRate.GetValue())
+
+	c = createCluster("other-cluster", "other-cluster", nil, services["other"], nil)[0].(*cluster.Cluster)
+	assert.Nil(t, c.CircuitBreakers)
+	assert.Nil(t, c.OutlierDetection)
+}
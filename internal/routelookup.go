@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	// registers the grpc.lookup.v1 messages, of which gRPC does not export the generated types
+	_ "google.golang.org/grpc/balancer/rls"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// routeLookupPluginName is the name of the cluster specifier plugin in the route configurations
+const routeLookupPluginName = "rls"
+
+// keys of the route lookup requests
+const (
+	routeLookupServiceKey   = "service"
+	routeLookupAuthorityKey = "authority"
+	routeLookupKey          = "key"
+)
+
+// RouteLookupConfig routes the calls to a service by a request header, e.g. to the shard of a tenant, using the
+// Route Lookup Service (gRPC A28). The control plane answers the lookups of the clients.
+type RouteLookupConfig struct {
+	// GrpcServices are the full names of the gRPC services of which the calls are routed, like example.v1.Example
+	GrpcServices []string `mapstructure:"grpcServices"`
+	// Header holds the routing key, like x-tenant-id
+	Header string `mapstructure:"header"`
+	// Targets maps the header values to the services that serve them
+	Targets map[string]string `mapstructure:"targets"`
+	// Default is the service of calls without a known header value, defaults to the service itself
+	Default string `mapstructure:"default"`
+}
+
+func (cfg RouteLookupConfig) target(service string, key string) string {
+	if target, has := cfg.Targets[key]; has {
+		return target
+	}
+	if cfg.Default != "" {
+		return cfg.Default
+	}
+	return service
+}
+
+// useRouteLookup routes the calls of the route configuration by the lookups of the clients at lookupService. Calls that
+// are not routed by the lookups (like those of clients without RLS support) go to the cluster of the service itself.
+func useRouteLookup(rc *route.RouteConfiguration, naming resourceNaming, service string, cfg RouteLookupConfig, lookupService string) error {
+	constantKeys := map[string]string{routeLookupServiceKey: service}
+	if naming.authority != "" {
+		constantKeys[routeLookupAuthorityKey] = naming.authority
+	}
+	names := []interface{}{}
+	for _, grpcService := range cfg.GrpcServices {
+		names = append(names, map[string]string{"service": grpcService})
+	}
+	builder := map[string]interface{}{
+		"names":        names,
+		"headers":      []interface{}{map[string]interface{}{"key": routeLookupKey, "names": []string{cfg.Header}}},
+		"constantKeys": constantKeys,
+	}
+	specifier, err := lookupMessage("grpc.lookup.v1.RouteLookupClusterSpecifier", map[string]interface{}{
+		"routeLookupConfig": map[string]interface{}{
+			"grpcKeybuilders":      []interface{}{builder},
+			"lookupService":        lookupService,
+			"lookupServiceTimeout": "1s",
+			"maxAge":               "300s",
+			"cacheSizeBytes":       "1048576",
+			"defaultTarget":        naming.cluster(cfg.target(service, "")),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	rc.ClusterSpecifierPlugins = append(rc.ClusterSpecifierPlugins, &route.ClusterSpecifierPlugin{
+		Extension: &core.TypedExtensionConfig{
+			Name:        routeLookupPluginName,
+			TypedConfig: any(specifier),
+		},
+		IsOptional: true,
+	})
+	for _, vh := range rc.VirtualHosts {
+		fallback := vh.Routes[len(vh.Routes)-1]
+		lookup := proto.Clone(fallback).(*route.Route)
+		lookup.GetRoute().ClusterSpecifier = &route.RouteAction_ClusterSpecifierPlugin{ClusterSpecifierPlugin: routeLookupPluginName}
+		vh.Routes = append(vh.Routes[:len(vh.Routes)-1], lookup, fallback)
+	}
+	return nil
+}
+
+// RouteLookupServer answers the route lookups of the clients, with the clusters of the services configured for the keys
+type RouteLookupServer struct {
+	Services Services
+}
+
+// RouteLookup returns the cluster of the target of the lookup keys
+func (s *RouteLookupServer) RouteLookup(ctx context.Context, keys map[string]string) ([]string, error) {
+	service := keys[routeLookupServiceKey]
+	cfg := s.Services[service].RouteLookup
+	if cfg == nil {
+		return nil, status.Errorf(codes.NotFound, "no route lookup for service %q", service)
+	}
+	naming := resourceNaming{authority: keys[routeLookupAuthorityKey]}
+	return []string{naming.cluster(cfg.target(service, keys[routeLookupKey]))}, nil
+}
+
+// registerRouteLookupService registers the grpc.lookup.v1.RouteLookupService
+func registerRouteLookupService(grpcServer *grpc.Server, server *RouteLookupServer) {
+	grpcServer.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "grpc.lookup.v1.RouteLookupService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "RouteLookup",
+			Handler:    routeLookupHandler,
+		}},
+		Metadata: "grpc/lookup/v1/rls.proto",
+	}, server)
+}
+
+func routeLookupHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req, err := lookupMessage("grpc.lookup.v1.RouteLookupRequest", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		marshaled, err := protojson.Marshal(req.(proto.Message))
+		if err != nil {
+			return nil, err
+		}
+		var request struct {
+			KeyMap map[string]string `json:"keyMap"`
+		}
+		if err := json.Unmarshal(marshaled, &request); err != nil {
+			return nil, err
+		}
+		targets, err := srv.(*RouteLookupServer).RouteLookup(ctx, request.KeyMap)
+		if err != nil {
+			return nil, err
+		}
+		zap.L().Debug("Route lookup", zap.Any("keys", request.KeyMap), zap.Strings("targets", targets))
+		return lookupMessage("grpc.lookup.v1.RouteLookupResponse", map[string]interface{}{"targets": targets})
+	}
+	if interceptor == nil {
+		return handler(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/grpc.lookup.v1.RouteLookupService/RouteLookup"}
+	return interceptor(ctx, req, info, handler)
+}
+
+// lookupMessage creates a grpc.lookup.v1 message from its JSON form
+func lookupMessage(name protoreflect.FullName, fields map[string]interface{}) (proto.Message, error) {
+	typ, err := protoregistry.GlobalTypes.FindMessageByName(name)
+	if err != nil {
+		return nil, err
+	}
+	m := typ.New().Interface()
+	if fields == nil {
+		return m, nil
+	}
+	marshaled, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	if err := protojson.Unmarshal(marshaled, m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return m, nil
+}
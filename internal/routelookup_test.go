@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/xds"
+	"google.golang.org/protobuf/proto"
+)
+
+// rlsEnv enables the RLS cluster specifier plugin in gRPC (1.46)
+const rlsEnv = "GRPC_EXPERIMENTAL_XDS_RLS_LB"
+
+var tenants = RouteLookupConfig{
+	GrpcServices: []string{"example.v1.Example"},
+	Header:       "x-tenant-id",
+	Targets:      map[string]string{"acme": "tenants-acme", "globex": "tenants-globex"},
+}
+
+func TestGenerateSnapshotRouteLookup(t *testing.T) {
+	mapping := Mapping{"tenants": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}}
+	opts := Options{Services: Services{"tenants": {RouteLookup: &tenants}}, RouteLookupService: "dns:///k8s-xds:9000"}
+	ss, err := GenerateSnapshot(&core.Node{Id: "client"}, mapping, opts)
+	assert.NoError(t, err)
+	rc := ss.GetResources(resource.RouteType)["tenants-route"].(*route.RouteConfiguration)
+	assert.Len(t, rc.ClusterSpecifierPlugins, 1)
+	routes := rc.VirtualHosts[0].Routes
+	assert.Len(t, routes, 2)
+	assert.Equal(t, routeLookupPluginName, routes[0].GetRoute().GetClusterSpecifierPlugin())
+	assert.Equal(t, "tenants-cluster", routes[1].GetRoute().GetCluster())
+
+	// method routes look up the tenants too, and fall back like the catch-all route
+	methods := []MethodConfig{{Name: "example.v1.Example/DoSomething", Retries: proto.Uint32(3)}}
+	withMethods := Options{Services: Services{"tenants": {RouteLookup: &tenants, Methods: methods}}, RouteLookupService: opts.RouteLookupService}
+	ss, err = GenerateSnapshot(&core.Node{Id: "client"}, mapping, withMethods)
+	assert.NoError(t, err)
+	routes = ss.GetResources(resource.RouteType)["tenants-route"].(*route.RouteConfiguration).VirtualHosts[0].Routes
+	assert.Len(t, routes, 4)
+	for i, r := range routes[:2] {
+		assert.Equal(t, "/example.v1.Example/DoSomething", r.GetMatch().GetPath(), i)
+		assert.Equal(t, uint32(3), r.GetRoute().GetRetryPolicy().GetNumRetries().GetValue(), i)
+	}
+	assert.Equal(t, routeLookupPluginName, routes[0].GetRoute().GetClusterSpecifierPlugin())
+	assert.Equal(t, "tenants-cluster", routes[1].GetRoute().GetCluster())
+	assert.Equal(t, routeLookupPluginName, routes[2].GetRoute().GetClusterSpecifierPlugin())
+	assert.Equal(t, "tenants-cluster", routes[3].GetRoute().GetCluster())
+	assert.Nil(t, routes[3].GetRoute().RetryPolicy)
+	server := &RouteLookupServer{Services: opts.Services}
+	targets, err := server.RouteLookup(context.TODO(), map[string]string{routeLookupServiceKey: "tenants", routeLookupKey: "acme"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tenants-acme-cluster"}, targets)
+	targets, err = server.RouteLookup(context.TODO(), map[string]string{routeLookupServiceKey: "tenants", routeLookupKey: "unknown", routeLookupAuthorityKey: "west.k8s-xds"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"xdstp://west.k8s-xds/envoy.config.cluster.v3.Cluster/tenants"}, targets)
+	_, err = server.RouteLookup(context.TODO(), map[string]string{routeLookupServiceKey: "other"})
+	assert.Error(t, err)
+
+	// without the address of the lookup service, the calls go to the service itself
+	ss, err = GenerateSnapshot(&core.Node{Id: "client"}, mapping, Options{Services: opts.Services})
+	assert.NoError(t, err)
+	assert.Empty(t, ss.GetResources(resource.RouteType)["tenants-route"].(*route.RouteConfiguration).ClusterSpecifierPlugins)
+}
+
+// TestXdsRouteLookup routes the calls of tenants to their own backends
+func TestXdsRouteLookup(t *testing.T) {
+	if rerunWithEnv(t, rlsEnv) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	go runServer(8080)
+	go runServer(8081)
+	go runServer(8082)
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9080)
+	config.Set("managementServer.address", "dns:///localhost:9080")
+	config.Set("services", map[string]interface{}{"tenants": map[string]interface{}{"routeLookup": map[string]interface{}{
+		"grpcServices": tenants.GrpcServices,
+		"header":       tenants.Header,
+		"targets":      tenants.Targets,
+	}}})
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{
+		"tenants":        {"europe-west4-a": {{IP: "127.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"tenants-acme":   {"europe-west4-a": {{IP: "127.0.0.1", Port: 8081, Zone: "europe-west4-a"}}},
+		"tenants-globex": {"europe-west4-a": {{IP: "127.0.0.1", Port: 8082, Zone: "europe-west4-a"}}},
+	})
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting([]byte(`{
+  "xds_servers": [{"server_uri": "localhost:9080", "channel_creds": [{"type": "insecure"}], "server_features": ["xds_v3"]}],
+  "node": {"id": "tenant-client", "locality": {"zone": "europe-west4-a"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := grpc.DialContext(ctx, "xds:///tenants", grpc.WithInsecure(), grpc.WithResolvers(resolver))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	for tenant, port := range map[string]int{"acme": 8081, "globex": 8082, "initech": 8080} {
+		ctx := metadata.AppendToOutgoingContext(ctx, tenants.Header, tenant)
+		assert.Equal(t, fmt.Sprintf("Hi hello world from %d", port), runClient(ctx, c), tenant)
+	}
+}
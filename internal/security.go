@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// SecurityConfig enables mutual TLS between xDS enabled gRPC clients and servers, read from the `security` config key.
+// Certificates are not distributed by the control plane: clients and servers load them using the certificate
+// provider instance (e.g. a file_watcher plugin) with the configured name, defined in their bootstrap file.
+type SecurityConfig struct {
+	MTLS                bool   `mapstructure:"mtls"`
+	CertificateProvider string `mapstructure:"certificateProvider"`
+	TrustDomain         string `mapstructure:"trustDomain"`
+}
+
+// ReadSecurity reads the security configuration
+func ReadSecurity(config *viper.Viper) (SecurityConfig, error) {
+	security := SecurityConfig{CertificateProvider: "default", TrustDomain: "cluster.local"}
+	err := config.UnmarshalKey("security", &security)
+	return security, err
+}
+
+// enabled reports whether calls to the service use mutual TLS
+func (s SecurityConfig) enabled(cfg ServiceConfig) bool {
+	return s.MTLS && !cfg.Plaintext
+}
+
+// spiffeID is the SPIFFE identity of a Kubernetes ServiceAccount
+func (s SecurityConfig) spiffeID(namespace, serviceAccount string) string {
+	return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", s.TrustDomain, namespace, serviceAccount)
+}
+
+// serverIdentities lists the identities the servers of the service are allowed to present:
+// the configured ServiceAccounts or otherwise those of the discovered pods
+func (s SecurityConfig) serverIdentities(zones map[string][]podEndPoint, cfg ServiceConfig) []string {
+	seen := map[string]bool{}
+	ids := []string{}
+	add := func(namespace, serviceAccount string) {
+		id := s.spiffeID(namespace, serviceAccount)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, serviceAccount := range cfg.ServiceAccounts {
+		if parts := strings.SplitN(serviceAccount, "/", 2); len(parts) == 2 {
+			add(parts[0], parts[1])
+		}
+	}
+	if len(ids) == 0 {
+		for _, endpoints := range zones {
+			for _, e := range endpoints {
+				if e.ServiceAccount != "" {
+					add(e.Namespace, e.ServiceAccount)
+				}
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// serviceNamespace is the namespace of the discovered endpoints of the service
+func serviceNamespace(zones map[string][]podEndPoint) string {
+	for _, endpoints := range zones {
+		for _, e := range endpoints {
+			if e.Namespace != "" {
+				return e.Namespace
+			}
+		}
+	}
+	return ""
+}
+
+func (s SecurityConfig) certificateProvider() *tls.CertificateProviderPluginInstance {
+	return &tls.CertificateProviderPluginInstance{InstanceName: s.CertificateProvider}
+}
+
+// upstreamTransportSocket makes clients verify that servers present one of the identities. Until the identities are
+// known, e.g. before the ServiceAccounts of the pods are resolved, servers must present an identity of the namespace of
+// the service, so the check never accepts any certificate of the CA. Without a namespace no identity matches.
+func (s SecurityConfig) upstreamTransportSocket(identities []string, namespace string) *core.TransportSocket {
+	validation := &tls.CertificateValidationContext{CaCertificateProviderInstance: s.certificateProvider()}
+	for _, id := range identities {
+		validation.MatchSubjectAltNames = append(validation.MatchSubjectAltNames, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Exact{Exact: id},
+		})
+	}
+	if len(identities) == 0 {
+		validation.MatchSubjectAltNames = []*matcher.StringMatcher{{
+			MatchPattern: &matcher.StringMatcher_Prefix{Prefix: s.spiffeID(namespace, "")},
+		}}
+	}
+	return &core.TransportSocket{
+		Name: wellknown.TransportSocketTls,
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: any(&tls.UpstreamTlsContext{
+				CommonTlsContext: &tls.CommonTlsContext{
+					TlsCertificateProviderInstance: s.certificateProvider(),
+					ValidationContextType:          &tls.CommonTlsContext_ValidationContext{ValidationContext: validation},
+				},
+			}),
+		},
+	}
+}
+
+// downstreamTransportSocket makes servers require client certificates, which are authorized using RBAC principals
+func (s SecurityConfig) downstreamTransportSocket() *core.TransportSocket {
+	return &core.TransportSocket{
+		Name: wellknown.TransportSocketTls,
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: any(&tls.DownstreamTlsContext{
+				CommonTlsContext: &tls.CommonTlsContext{
+					TlsCertificateProviderInstance: s.certificateProvider(),
+					ValidationContextType: &tls.CommonTlsContext_ValidationContext{ValidationContext: &tls.CertificateValidationContext{
+						CaCertificateProviderInstance: s.certificateProvider(),
+					}},
+				},
+				RequireClientCertificate: wrapperspb.Bool(true),
+			}),
+		},
+	}
+}
@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	examplev1 "github.com/hermanbanken/k8s-xds/example/pkg/gen/v1"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	xdscreds "google.golang.org/grpc/credentials/xds"
+	"google.golang.org/grpc/xds"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServerIdentities(t *testing.T) {
+	security := SecurityConfig{MTLS: true, TrustDomain: "cluster.local"}
+	zones := map[string][]podEndPoint{
+		"europe-west4-a": {{IP: "10.0.0.1", Namespace: "default", ServiceAccount: "example-server"}},
+		"europe-west4-b": {{IP: "10.0.0.2", Namespace: "default", ServiceAccount: "example-server"}, {IP: "10.0.0.3"}},
+	}
+	assert.Equal(t, []string{"spiffe://cluster.local/ns/default/sa/example-server"}, security.serverIdentities(zones, ServiceConfig{}))
+	assert.Equal(t, []string{"spiffe://cluster.local/ns/other/sa/server"}, security.serverIdentities(zones, ServiceConfig{ServiceAccounts: []string{"other/server"}}))
+	assert.False(t, security.enabled(ServiceConfig{Plaintext: true}))
+
+	matchers := func(socket *core.TransportSocket) []*matcher.StringMatcher {
+		upstream := &tls.UpstreamTlsContext{}
+		assert.NoError(t, socket.GetTypedConfig().UnmarshalTo(upstream))
+		return upstream.CommonTlsContext.GetValidationContext().MatchSubjectAltNames
+	}
+	sans := matchers(security.upstreamTransportSocket(security.serverIdentities(zones, ServiceConfig{}), "default"))
+	assert.Len(t, sans, 1)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/example-server", sans[0].GetExact())
+	// until the ServiceAccounts are known, only the identities of the namespace match
+	sans = matchers(security.upstreamTransportSocket(security.serverIdentities(map[string][]podEndPoint{}, ServiceConfig{}), "default"))
+	assert.Len(t, sans, 1)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/", sans[0].GetPrefix())
+	// without a namespace no identity matches
+	sans = matchers(security.upstreamTransportSocket(nil, ""))
+	assert.Equal(t, "spiffe://cluster.local/ns//sa/", sans[0].GetPrefix())
+}
+
+func TestServiceAccounts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	pod := func(name, serviceAccount string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: Namespace()}, Spec: corev1.PodSpec{ServiceAccountName: serviceAccount}}
+	}
+	m := fake.NewSimpleClientset(pod("a", "sa-a"))
+	emitted := make(chan Slice, 10)
+	accounts := watchServiceAccounts(ctx, m, func(_ watch.EventType, slice Slice) { emitted <- slice })
+	slice := func(name string, pods ...string) Slice {
+		s := Slice{Name: name}
+		for _, pod := range pods {
+			s.Endpoints = append(s.Endpoints, Endpoint{Pod: pod})
+		}
+		return s
+	}
+
+	first := slice("search-1", "a", "b")
+	accounts.resolve(watch.Added, &first)
+	assert.Equal(t, "sa-a", first.Endpoints[0].ServiceAccount)
+	assert.Equal(t, "", first.Endpoints[1].ServiceAccount)
+	second := slice("search-2", "a")
+	accounts.resolve(watch.Added, &second)
+
+	// the pod is kept while another slice refers to it
+	first = slice("search-1", "b")
+	accounts.resolve(watch.Modified, &first)
+	accounts.Lock()
+	assert.Equal(t, 1, accounts.accounts["a"].refs)
+	accounts.Unlock()
+
+	// the slice is emitted again once its pod is known
+	_, err := m.CoreV1().Pods(Namespace()).Create(ctx, pod("b", "sa-b"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	select {
+	case s := <-emitted:
+		assert.Equal(t, "search-1", s.Name)
+		assert.Equal(t, "sa-b", s.Endpoints[0].ServiceAccount)
+	case <-time.After(5 * time.Second):
+		t.Error("slice not emitted with the ServiceAccount of its pod")
+	}
+
+	// and again once its pod is ready, with the time it became ready
+	ready := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	b := pod("b", "sa-b")
+	b.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastTransitionTime: ready}}
+	_, err = m.CoreV1().Pods(Namespace()).Update(ctx, b, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	select {
+	case s := <-emitted:
+		assert.Equal(t, "search-1", s.Name)
+		assert.True(t, ready.Time.Equal(s.Endpoints[0].ReadySince))
+	case <-time.After(5 * time.Second):
+		t.Error("slice not emitted with the Ready time of its pod")
+	}
+	third := slice("search-3", "b")
+	accounts.resolve(watch.Added, &third)
+	assert.True(t, ready.Time.Equal(third.Endpoints[0].ReadySince))
+
+	accounts.resolve(watch.Deleted, &second)
+	accounts.Lock()
+	assert.NotContains(t, accounts.accounts, "a")
+	assert.Contains(t, accounts.accounts, "b")
+	accounts.Unlock()
+}
+
+func TestXdsMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificates(t, dir, "example-server", "example-client")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9020)
+	config.Set("upstreamServices", []string{"example-server"})
+	config.Set("security", map[string]interface{}{"mtls": true})
+	config.Set("services", map[string]interface{}{
+		"example-server": map[string]interface{}{
+			"authorization": []map[string]interface{}{{"principals": []string{"spiffe://cluster.local/ns/default/sa/example-client"}}},
+		},
+	})
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"example-server": {
+		"europe-west4-a": {{IP: "127.0.0.1", Port: 8020, Zone: "europe-west4-a", Namespace: "default", ServiceAccount: "example-server"}},
+	}})
+
+	serverCreds, err := xdscreds.NewServerCredentials(xdscreds.ServerOptions{FallbackCreds: insecure.NewCredentials()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientCreds, err := xdscreds.NewClientCredentials(xdscreds.ClientOptions{FallbackCreds: insecure.NewCredentials()})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	serving := make(chan struct{})
+	grpcServer := xds.NewGRPCServer(
+		grpc.Creds(serverCreds),
+		xds.BootstrapContentsForTesting(testBootstrap(t, 9020, dir, "example-server")),
+		xds.ServingModeCallback(func(addr net.Addr, args xds.ServingModeChangeArgs) {
+			if args.Mode == connectivity.ServingModeServing {
+				close(serving)
+			}
+		}),
+	)
+	defer grpcServer.Stop()
+	examplev1.RegisterExampleServer(grpcServer, example{port: 8020})
+	lis, err := net.Listen("tcp", ":8020")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go grpcServer.Serve(lis)
+	select {
+	case <-serving:
+	case <-time.After(5 * time.Second):
+		t.Fatal("xDS server did not start serving")
+	}
+
+	resolver, err := xds.NewXDSResolverWithConfigForTesting(testBootstrap(t, 9020, dir, "example-client"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := grpc.DialContext(ctx, "xds:///example-server",
+		grpc.WithTransportCredentials(clientCreds),
+		grpc.WithResolvers(resolver))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Hi hello world from 8020", runClient(ctx, c))
+
+	// plaintext clients are rejected
+	plain, err := grpc.DialContext(ctx, "localhost:8020", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = examplev1.NewExampleClient(plain).DoSomething(ctx, &examplev1.ExampleRequest{Name: "plaintext"})
+	assert.Error(t, err)
+}
+
+// testBootstrap points the default certificate provider to the certificates of the given ServiceAccount
+func testBootstrap(t *testing.T, port int, dir string, serviceAccount string) []byte {
+	bootstrap, err := os.ReadFile("../example/bootstrap-server.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := fmt.Sprintf(`"certificate_providers": {"default": {"plugin_name": "file_watcher", "config": {
+		"certificate_file": %q, "private_key_file": %q, "ca_certificate_file": %q, "refresh_interval": "60s"}}},
+		"server_listener_resource_name_template"`,
+		filepath.Join(dir, serviceAccount+".pem"), filepath.Join(dir, serviceAccount+".key"), filepath.Join(dir, "ca.pem"))
+	contents := strings.Replace(string(bootstrap), "localhost:9000", fmt.Sprintf("localhost:%d", port), 1)
+	contents = strings.Replace(contents, `"server_listener_resource_name_template"`, providers, 1)
+	return []byte(contents)
+}
+
+// writeTestCertificates writes a CA and a certificate with SPIFFE identity for each ServiceAccount in the default namespace
+func writeTestCertificates(t *testing.T, dir string, serviceAccounts ...string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER)
+
+	for i, serviceAccount := range serviceAccounts {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := url.Parse(fmt.Sprintf("spiffe://cluster.local/ns/default/sa/%s", serviceAccount))
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: serviceAccount},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			URIs:         []*url.URL{id},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, filepath.Join(dir, serviceAccount+".pem"), "CERTIFICATE", der)
+		writePEM(t, filepath.Join(dir, serviceAccount+".key"), "PRIVATE KEY", keyDER)
+	}
+}
+
+func writePEM(t *testing.T, file string, typ string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// slowStartSteps are the weight updates that gRPC clients get during the window of an endpoint
+const slowStartSteps = 10
+
+// slowStartFullWeight is the weight of endpoints that are not (or no longer) starting
+const slowStartFullWeight = 100
+
+// SlowStartConfig ramps up the traffic to new endpoints, e.g. for services that are slow until they are warmed up.
+// Envoy ramps up the endpoints itself (slow_start_config), gRPC clients get the load balancing weights of the endpoints
+// updated in steps. gRPC (1.46) round robin ignores these weights, so gRPC clients only ramp up with affinity (ring hash).
+type SlowStartConfig struct {
+	// Window over which the weight of a new endpoint ramps up to the full weight
+	Window time.Duration `mapstructure:"window"`
+	// Aggression shapes the ramp: new_weight = weight * max(min_weight_percent, time_factor ^ (1 / aggression)), defaults to 1.0 (linear)
+	Aggression float64 `mapstructure:"aggression"`
+	// MinWeightPercent is the weight that new endpoints start with, defaults to 10
+	MinWeightPercent float64 `mapstructure:"minWeightPercent"`
+}
+
+func (cfg *SlowStartConfig) aggression() float64 {
+	if cfg.Aggression <= 0 {
+		return 1
+	}
+	return cfg.Aggression
+}
+
+func (cfg *SlowStartConfig) minWeightPercent() float64 {
+	if cfg.MinWeightPercent <= 0 {
+		return 10
+	}
+	return cfg.MinWeightPercent
+}
+
+// envoy is the slow_start_config of the round robin policy of Envoy
+func (cfg *SlowStartConfig) envoy(clusterName string) *cluster.Cluster_SlowStartConfig {
+	if cfg == nil || cfg.Window <= 0 {
+		return nil
+	}
+	return &cluster.Cluster_SlowStartConfig{
+		SlowStartWindow:  durationpb.New(cfg.Window),
+		Aggression:       &core.RuntimeDouble{DefaultValue: cfg.aggression(), RuntimeKey: fmt.Sprintf("%s.slow_start_aggression", clusterName)},
+		MinWeightPercent: &typev3.Percent{Value: cfg.minWeightPercent()},
+	}
+}
+
+// grpcSlowStart is the slow start of the gRPC clients of the service, nil when their policy ignores the weights
+func grpcSlowStart(zones map[string][]podEndPoint, cfg ServiceConfig) *SlowStartConfig {
+	if cfg.SlowStart == nil || cfg.SlowStart.Window <= 0 || serviceAffinity(zones, cfg) == nil {
+		return nil
+	}
+	return cfg.SlowStart
+}
+
+// weight of the endpoint at the last step of its ramp before now, nil when the service does not ramp up
+func (cfg *SlowStartConfig) weight(e podEndPoint, now time.Time) *wrapperspb.UInt32Value {
+	if cfg == nil || cfg.Window <= 0 {
+		return nil
+	}
+	factor := 1.0
+	if elapsed := sinceFirstSeen(e, now); !e.FirstSeen.IsZero() && elapsed < cfg.Window {
+		step := math.Floor(float64(elapsed) / float64(cfg.Window) * slowStartSteps)
+		factor = math.Max(cfg.minWeightPercent()/100, math.Pow(step/slowStartSteps, 1/cfg.aggression()))
+	}
+	weight := uint32(math.Round(factor * slowStartFullWeight))
+	if weight < 1 {
+		weight = 1
+	}
+	return &wrapperspb.UInt32Value{Value: weight}
+}
+
+// nextSlowStartStep is when the weight of an endpoint of gRPC clients steps up next, zero if no endpoint is ramping up
+func nextSlowStartStep(mapping Mapping, services Services, now time.Time) (next time.Time) {
+	for service, zones := range mapping {
+		cfg := grpcSlowStart(zones, services[service])
+		if cfg == nil {
+			continue
+		}
+		stepSize := cfg.Window / slowStartSteps
+		for _, endpoints := range zones {
+			for _, e := range endpoints {
+				elapsed := sinceFirstSeen(e, now)
+				if e.FirstSeen.IsZero() || elapsed >= cfg.Window || stepSize <= 0 {
+					continue
+				}
+				step := now.Add(-elapsed).Add((elapsed/stepSize + 1) * stepSize)
+				if next.IsZero() || step.Before(next) {
+					next = step
+				}
+			}
+		}
+	}
+	return next
+}
+
+// sinceFirstSeen is how long the endpoint has been ready, a Kubernetes time ahead of the clock of the control plane counts
+// as just now
+func sinceFirstSeen(e podEndPoint, now time.Time) time.Duration {
+	if elapsed := now.Sub(e.FirstSeen); elapsed > 0 {
+		return elapsed
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowStartWeights(t *testing.T) {
+	now := time.Now()
+	cfg := &SlowStartConfig{Window: 100 * time.Second}
+	for elapsed, weight := range map[time.Duration]uint32{0: 10, 35 * time.Second: 30, 99 * time.Second: 90, 100 * time.Second: 100} {
+		assert.Equal(t, weight, cfg.weight(podEndPoint{FirstSeen: now.Add(-elapsed)}, now).GetValue(), elapsed)
+	}
+	// endpoints that were there before the control plane started do not ramp up
+	assert.Equal(t, uint32(100), cfg.weight(podEndPoint{}, now).GetValue())
+	aggressive := &SlowStartConfig{Window: 100 * time.Second, Aggression: 2}
+	assert.Equal(t, uint32(45), aggressive.weight(podEndPoint{FirstSeen: now.Add(-25 * time.Second)}, now).GetValue())
+	var disabled *SlowStartConfig
+	assert.Nil(t, disabled.weight(podEndPoint{FirstSeen: now}, now))
+
+	mapping := Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", FirstSeen: now.Add(-35 * time.Second)}, {IP: "10.0.0.2"}}}}
+	assert.Equal(t, now.Add(5*time.Second), nextSlowStartStep(mapping, Services{"a": {SlowStart: cfg, Affinity: &AffinityConfig{Header: "x-user-id"}}}, now))
+	assert.True(t, nextSlowStartStep(mapping, Services{}, now).IsZero())
+	// gRPC round robin ignores the weights, so the weights do not step up
+	assert.True(t, nextSlowStartStep(mapping, Services{"a": {SlowStart: cfg}}, now).IsZero())
+}
+
+func TestFirstSeenFromKubernetes(t *testing.T) {
+	d := &DiscoveryImpl{}
+	ready := time.Now().Add(-time.Hour)
+	slices := map[string]Slice{"a-1": {Service: "a", Ports: []Port{{Port: 8080}}, Endpoints: []Endpoint{
+		{Addresses: []string{"10.0.0.1"}, ReadySince: ready},
+	}}}
+	m := d.computeMapping(slices, nil)
+	assert.Equal(t, ready, m["a"][""][0].FirstSeen)
+
+	// a Ready time ahead of the clock of the control plane starts the ramp now
+	now := time.Now()
+	cfg := &SlowStartConfig{Window: time.Minute}
+	assert.Equal(t, uint32(10), cfg.weight(podEndPoint{FirstSeen: now.Add(time.Second)}, now).GetValue())
+}
+
+func TestGenerateSnapshotSlowStart(t *testing.T) {
+	now := time.Now()
+	mapping := Mapping{"a": {"europe-west4-a": {
+		{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"},
+		{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a", FirstSeen: now},
+	}}}
+	slowStart := &SlowStartConfig{Window: time.Minute}
+	opts := Options{Services: Services{"a": {SlowStart: slowStart, Affinity: &AffinityConfig{Header: "x-user-id"}}}, Now: now}
+	ss, err := GenerateSnapshot(&core.Node{Id: "client", Locality: &core.Locality{Zone: "europe-west4-a"}}, mapping, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, cluster.Cluster_RING_HASH, ss.GetResources(resource.ClusterType)["a-cluster"].(*cluster.Cluster).LbPolicy)
+	weights := map[string]uint32{}
+	for _, e := range ss.GetResources(resource.EndpointType)["a-cluster"].(*endpoint.ClusterLoadAssignment).Endpoints[0].LbEndpoints {
+		weights[e.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = e.GetLoadBalancingWeight().GetValue()
+	}
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 100, "10.0.0.2": 10}, weights)
+
+	// gRPC round robin ignores the weights, the clients get none
+	grpcOpts := Options{Services: Services{"a": {SlowStart: slowStart}}, Now: now}
+	ss, err = GenerateSnapshot(&core.Node{Id: "client", Locality: &core.Locality{Zone: "europe-west4-a"}}, mapping, grpcOpts)
+	assert.NoError(t, err)
+	for _, e := range ss.GetResources(resource.EndpointType)["a-cluster"].(*endpoint.ClusterLoadAssignment).Endpoints[0].LbEndpoints {
+		assert.Nil(t, e.LoadBalancingWeight)
+	}
+
+	// Envoy ramps up the endpoints itself
+	ss, err = GenerateSnapshot(&core.Node{Id: "envoy", UserAgentName: "envoy", Locality: &core.Locality{Zone: "europe-west4-a"}}, mapping, grpcOpts)
+	assert.NoError(t, err)
+	c := ss.GetResources(resource.ClusterType)["a-cluster"].(*cluster.Cluster)
+	assert.NoError(t, c.ValidateAll())
+	assert.Equal(t, time.Minute, c.GetRoundRobinLbConfig().GetSlowStartConfig().GetSlowStartWindow().AsDuration())
+	for _, e := range ss.GetResources(resource.EndpointType)["a-cluster"].(*endpoint.ClusterLoadAssignment).Endpoints[0].LbEndpoints {
+		assert.Nil(t, e.LoadBalancingWeight)
+	}
+}
@@ -1,11 +1,12 @@
 package internal
 
 import (
-	"fmt"
 	"hash/fnv"
 	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
@@ -18,7 +19,6 @@ import (
 	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -28,45 +28,172 @@ import (
 type Mapping = map[string]map[string][]podEndPoint
 
 type podEndPoint struct {
-	IP   string
-	Port int32
-	Zone string
+	IP             string
+	Port           int32
+	Zone           string
+	Namespace      string
+	ServiceAccount string
+	// Hostname is resolved by the clients (logical DNS) instead of the IP, for ExternalName services and external hosts
+	Hostname string
+	// ClusterIP marks the virtual IP of the Service, which replaces the Pod IPs in the clusterIP endpoint mode
+	ClusterIP bool
+	// Draining marks an endpoint that was removed, which gets no new calls until it is gone
+	Draining bool
+	// FirstSeen is when the endpoint became ready in Kubernetes, zero if unknown
+	FirstSeen time.Time
+	// Affinity of the Service of the endpoint, by its annotations or sessionAffinity
+	Affinity *AffinityConfig
 }
 
-// GenerateSnapshot creates snapshot for each service
-func GenerateSnapshot(node *core.Node, mapping Mapping) (*cache.Snapshot, error) {
-	// Using maximum number of endpoints requires randomness to avoid subsetting the possible large amount of endpoints
-	// This requires a seed that is stable per node, so we hash the node id.
-	h := fnv.New64a()
-	h.Write([]byte(node.Id))
-	seed := int64(h.Sum64())
+// Options carries the control plane state, besides the discovered endpoints, that shapes the generated resources
+type Options struct {
+	Services Services
+	Security SecurityConfig
+	Faults   []FaultExperiment
+	// ClusterDomain is the DNS suffix of the Kubernetes cluster, defaults to cluster.local
+	ClusterDomain string
+	// Authority serves the resources under xdstp names of the authority as well (xDS federation), for clients that request them
+	Authority string
+	// RouteLookupService is the gRPC target at which clients look up the routes of services with a RouteLookup configuration
+	RouteLookupService string
+	// LoadReporting makes clients report their loads to the control plane
+	LoadReporting bool
+	// Health marks the endpoints that fail the health checks of the control plane as unhealthy, nil marks all healthy
+	Health *HealthChecker
+	// Now is the time of the snapshot, at which the weights of slow starting endpoints are taken; defaults to the current time
+	Now time.Time
+	// EndpointTTL makes clients drop endpoints that are not refreshed by heartbeats, zero disables it
+	EndpointTTL time.Duration
+	// Subscriptions limits the resources to the services subscribed to by the nodes, nil generates all services
+	Subscriptions *Subscriptions
+	// Descriptors of the gRPC services, of which the methods get their own routes
+	Descriptors *Descriptors
+}
 
-	var ownZone string
-	if node.Locality != nil {
-		ownZone = node.Locality.Zone
+func (opts Options) clusterDomain() string {
+	if opts.ClusterDomain == "" {
+		return defaultClusterDomain
 	}
+	return opts.ClusterDomain
+}
+
+// GenerateSnapshot creates snapshot for each service
+func GenerateSnapshot(node *core.Node, mapping Mapping, opts Options) (*cache.Snapshot, error) {
+	return generateSnapshot(classOf(node), mapping, opts)
+}
+
+// generateSnapshot creates the snapshot shared by the nodes of the class
+func generateSnapshot(class nodeClass, mapping Mapping, opts Options) (*cache.Snapshot, error) {
+	seed := class.Subset
+	ownZone := class.Zone
 
 	zap.L().Debug("K8s", zap.Any("EndPoints", mapping))
 	var eds []types.Resource
 	var cds []types.Resource
 	var rds []types.Resource
 	var lds []types.Resource
-	for service, podEndPoints := range mapping {
+	envoy := class.Envoy
+	mapping = applyEndpointModes(mapping, opts.Services)
+	subscribed := opts.Subscriptions.filter(mapping)
+	namings := opts.Subscriptions.namings(opts.Authority)
+	if envoy {
+		// Envoy requests the plain names
+		namings = []resourceNaming{{}}
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	for service, podEndPoints := range subscribed {
 		zap.L().Debug("Creating new xDS Entry", zap.String("service", service))
-		eds = append(eds, clusterLoadAssignment(podEndPoints, fmt.Sprintf("%s-cluster", service), ownZone, seed)...)
-		cds = append(cds, createCluster(fmt.Sprintf("%s-cluster", service))...)
-		rds = append(rds, createRoute(fmt.Sprintf("%s-route", service), fmt.Sprintf("%s-vhost", service), service, fmt.Sprintf("%s-cluster", service))...)
-		lds = append(lds, createListener(service, fmt.Sprintf("%s-cluster", service), fmt.Sprintf("%s-route", service))...)
+		var transportSocket *core.TransportSocket
+		if opts.Security.enabled(opts.Services[service]) {
+			transportSocket = opts.Security.upstreamTransportSocket(opts.Security.serverIdentities(podEndPoints, opts.Services[service]), serviceNamespace(podEndPoints))
+		}
+		var httpFilters []*hcm.HttpFilter
+		experiment := faultFor(opts.Faults, service, ownZone)
+		if experiment != nil {
+			httpFilters = append(httpFilters, faultFilter())
+		}
+		// the service can be dialed by all of its DNS names, like `xds:///example-server.default:9090`
+		names := aliasDomains(serviceAliases(service, serviceNamespace(podEndPoints), opts.clusterDomain()), servicePorts(podEndPoints, opts.Services[service]))
+		failover := failoverServices(service, opts.Services[service], mapping)
+		affinity := serviceAffinity(podEndPoints, opts.Services[service])
+		methods, err := methodRoutes(opts.Services[service], opts.Descriptors)
+		if err != nil {
+			zap.L().Error("Invalid method routes", zap.String("service", service), zap.Error(err))
+		}
+		// Envoy ramps up new endpoints itself, gRPC clients with a ring hash get their weights in steps
+		var weight func(podEndPoint) *wrapperspb.UInt32Value
+		if slowStart := grpcSlowStart(podEndPoints, opts.Services[service]); slowStart != nil && !envoy {
+			weight = func(e podEndPoint) *wrapperspb.UInt32Value { return slowStart.weight(e, now) }
+		}
+		for _, naming := range namings {
+			clusters := createCluster(naming.cluster(service), naming.endpoints(service), podEndPoints, opts.Services[service], transportSocket)
+			if clusters[0].(*cluster.Cluster).GetType() == cluster.Cluster_EDS {
+				eds = append(eds, clusterLoadAssignment(podEndPoints, naming.endpoints(service), ownZone, seed, opts.Health, weight)...)
+			}
+			if opts.LoadReporting {
+				clusters[0].(*cluster.Cluster).LrsServer = selfConfigSource()
+			}
+			useAffinity(clusters[0].(*cluster.Cluster), affinity, envoy)
+			cds = append(cds, clusters...)
+			if len(failover) > 0 {
+				aggregate := createFailoverCluster(naming, service, failover, envoy)
+				// gRPC balances the calls by the policy of the aggregate cluster, Envoy by those of its clusters
+				if !envoy {
+					useAffinity(aggregate[0].(*cluster.Cluster), affinity, envoy)
+				}
+				cds = append(cds, aggregate...)
+			}
+			target := upstreamCluster(naming, service, failover)
+			if envoy {
+				continue
+			}
+			routes := createRoute(naming.route(service), naming.virtualHost(service), naming.domains(names), target, faultPerFilterConfig(experiment))
+			if lookup := opts.Services[service].RouteLookup; lookup != nil && opts.RouteLookupService != "" {
+				if err := useRouteLookup(routes[0].(*route.RouteConfiguration), naming, service, *lookup, opts.RouteLookupService); err != nil {
+					zap.L().Error("Invalid route lookup", zap.String("service", service), zap.Error(err))
+				}
+			}
+			useMethodRoutes(routes[0].(*route.RouteConfiguration).VirtualHosts[0], methods)
+			useHashPolicies(routes[0].(*route.RouteConfiguration).VirtualHosts[0], hashPolicies(affinity, envoy))
+			rds = append(rds, routes...)
+			for _, name := range names {
+				lds = append(lds, createListener(naming.listener(name), target, naming.route(service), httpFilters...)...)
+			}
+		}
+	}
+
+	// Envoy proxies need real listeners, proxyless gRPC clients use the API listeners created above
+	if envoy {
+		lds, rds = createEnvoyListeners(subscribed, opts, ownZone)
+	}
+
+	// xDS enabled gRPC servers request inbound listeners for their own service
+	if service := class.Service; service != "" {
+		cfg := opts.Services[service]
+		var transportSocket *core.TransportSocket
+		if opts.Security.enabled(cfg) {
+			transportSocket = opts.Security.downstreamTransportSocket()
+		}
+		for _, naming := range namings {
+			lds = append(lds, createInboundListeners(naming, service, servicePorts(mapping[service], cfg), cfg, transportSocket)...)
+		}
 	}
 
-	version := uuid.New()
-	zap.L().Debug("Creating Snapshot", zap.String("version", version.String()), zap.Any("EDS", eds), zap.Any("CDS", cds), zap.Any("RDS", rds), zap.Any("LDS", lds))
-	snapshot, err := cache.NewSnapshot(version.String(), map[resource.Type][]types.Resource{
+	zap.L().Debug("Creating Snapshot", zap.Any("EDS", eds), zap.Any("CDS", cds), zap.Any("RDS", rds), zap.Any("LDS", lds))
+	// gRPC (1.46) does not support TTLs, it would reject the heartbeats without a resource
+	ttls := map[resource.Type]time.Duration{}
+	if opts.EndpointTTL > 0 && class.Envoy {
+		ttls[resource.EndpointType] = opts.EndpointTTL
+	}
+	snapshot, err := newSnapshot(map[resource.Type][]types.Resource{
 		resource.EndpointType: eds,
 		resource.ClusterType:  cds,
 		resource.RouteType:    rds,
 		resource.ListenerType: lds,
-	})
+	}, ttls)
 	if err != nil {
 		zap.L().Error("Snapshot error", zap.Any("snapshot", snapshot), zap.Error(err))
 	} else if err := snapshot.Consistent(); err != nil {
@@ -75,7 +202,64 @@ func GenerateSnapshot(node *core.Node, mapping Mapping) (*cache.Snapshot, error)
 	return snapshot, nil
 }
 
-func clusterLoadAssignment(zones map[string][]podEndPoint, clusterName string, ownZone string, seed int64) []types.Resource {
+// newSnapshot versions each resource type by the hash of its content, so unchanged types are not sent again and
+// replicas of the control plane agree on the versions
+func newSnapshot(resources map[resource.Type][]types.Resource, ttls map[resource.Type]time.Duration) (*cache.Snapshot, error) {
+	snapshot := &cache.Snapshot{}
+	for typ, items := range resources {
+		version, err := contentVersion(items)
+		if err != nil {
+			return nil, err
+		}
+		ttl, hasTTL := ttls[typ]
+		if !hasTTL {
+			snapshot.Resources[cache.GetResponseType(typ)] = cache.NewResources(version, items)
+			continue
+		}
+		withTTL := make([]types.ResourceWithTTL, 0, len(items))
+		for _, item := range items {
+			withTTL = append(withTTL, types.ResourceWithTTL{Resource: item, TTL: &ttl})
+		}
+		snapshot.Resources[cache.GetResponseType(typ)] = cache.NewResourcesWithTTL(version, withTTL)
+	}
+	return snapshot, nil
+}
+
+// snapshotTTLs are the TTLs of the resource types of the snapshot
+func snapshotTTLs(snapshot *cache.Snapshot) map[resource.Type]time.Duration {
+	ttls := map[resource.Type]time.Duration{}
+	for _, typ := range []resource.Type{resource.ClusterType, resource.EndpointType, resource.ListenerType, resource.RouteType} {
+		for _, r := range snapshot.GetResourcesAndTTL(typ) {
+			if r.TTL != nil {
+				ttls[typ] = *r.TTL
+			}
+			break
+		}
+	}
+	return ttls
+}
+
+// contentVersion hashes the names and (deterministically marshaled) contents of the resources, regardless of their order
+func contentVersion(items []types.Resource) (string, error) {
+	hashes := make([]string, 0, len(items))
+	for _, item := range items {
+		marshaled, err := cache.MarshalResource(item)
+		if err != nil {
+			return "", err
+		}
+		hashes = append(hashes, cache.GetResourceName(item)+"="+cache.HashResource(marshaled))
+	}
+	sort.Strings(hashes)
+	h := fnv.New64a()
+	for _, hash := range hashes {
+		h.Write([]byte(hash))
+		h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
+
+// clusterLoadAssignment creates the endpoints of a cluster, weighted by the endpointWeight function if any
+func clusterLoadAssignment(zones map[string][]podEndPoint, clusterName string, ownZone string, seed int64, health *HealthChecker, endpointWeight func(podEndPoint) *wrapperspb.UInt32Value) []types.Resource {
 	r := rand.New(rand.NewSource(seed))
 	cla := &endpoint.ClusterLoadAssignment{ClusterName: clusterName}
 
@@ -83,10 +267,15 @@ func clusterLoadAssignment(zones map[string][]podEndPoint, clusterName string, o
 	zoneNames := []string{}
 	for zone, endpoints := range zones {
 		zoneNames = append(zoneNames, zone)
-		zoneTotal += len(endpoints)
+		for _, e := range endpoints {
+			if !e.Draining {
+				zoneTotal++
+			}
+		}
 	}
 
-	// Process our own zone first
+	// Process our own zone first; the order must be stable, so unchanged assignments are not resent by delta xDS
+	sort.Strings(zoneNames)
 	prioritySort(zoneNames, ownZone)
 
 	// Add at most max(5, total/3) endpoints to each cluster
@@ -97,7 +286,8 @@ func clusterLoadAssignment(zones map[string][]podEndPoint, clusterName string, o
 
 outerLoop:
 	for _, zone := range zoneNames {
-		podEndpoints := zones[zone]
+		// the mapping is shared by all nodes, so sort a copy
+		podEndpoints := append([]podEndPoint(nil), zones[zone]...)
 
 		// Locality Weighted Load Balancing
 		// @see https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/load_balancing/locality_weight
@@ -116,14 +306,18 @@ outerLoop:
 		cla.Endpoints = append(cla.Endpoints, locality)
 
 		sort.Slice(podEndpoints, func(i, j int) bool {
+			if podEndpoints[i].IP == podEndpoints[j].IP {
+				return podEndpoints[i].Port < podEndpoints[j].Port
+			}
 			return strings.Compare(podEndpoints[i].IP, podEndpoints[j].IP) < 0
 		})
 		randomForEach(podEndpoints, r, func(i int) {
-			if remainingEndpoints == 0 {
+			podEndPoint := podEndpoints[i]
+			// draining endpoints do not take the place of live endpoints
+			if remainingEndpoints == 0 && !podEndPoint.Draining {
 				return
 			}
 
-			podEndPoint := podEndpoints[i]
 			zap.L().Debug("Creating ENDPOINT", zap.String("host", podEndPoint.IP), zap.Int32("port", podEndPoint.Port))
 			hst := &core.Address{Address: &core.Address_SocketAddress{
 				SocketAddress: &core.SocketAddress{
@@ -134,14 +328,20 @@ outerLoop:
 					},
 				},
 			}}
-			locality.LbEndpoints = append(locality.LbEndpoints, &endpoint.LbEndpoint{
+			lbEndpoint := &endpoint.LbEndpoint{
 				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 					Endpoint: &endpoint.Endpoint{
 						Address: hst,
 					}},
-				HealthStatus: core.HealthStatus_HEALTHY,
-			})
-			remainingEndpoints--
+				HealthStatus: endpointStatus(podEndPoint, health),
+			}
+			if endpointWeight != nil {
+				lbEndpoint.LoadBalancingWeight = endpointWeight(podEndPoint)
+			}
+			locality.LbEndpoints = append(locality.LbEndpoints, lbEndpoint)
+			if !podEndPoint.Draining {
+				remainingEndpoints--
+			}
 		})
 		if remainingEndpoints == 0 {
 			break outerLoop
@@ -152,28 +352,50 @@ outerLoop:
 	return []types.Resource{cla}
 }
 
-func createCluster(clusterName string) []types.Resource {
+// endpointStatus is the health status of the endpoint in EDS: draining endpoints get no new calls
+func endpointStatus(e podEndPoint, health *HealthChecker) core.HealthStatus {
+	if e.Draining {
+		return core.HealthStatus_DRAINING
+	}
+	return health.Status(e)
+}
+
+// createCluster creates an EDS cluster, the endpoints are fetched by edsServiceName when it differs from the clusterName.
+// Services with a DNS endpoint get a logical DNS cluster instead, which the clients resolve themselves.
+func createCluster(clusterName string, edsServiceName string, zones map[string][]podEndPoint, cfg ServiceConfig, transportSocket *core.TransportSocket) []types.Resource {
 	zap.L().Debug("Creating CLUSTER", zap.String("name", clusterName))
+	if edsServiceName == clusterName {
+		edsServiceName = ""
+	}
 	cls := []types.Resource{
 		&cluster.Cluster{
 			Name:                 clusterName,
 			LbPolicy:             cluster.Cluster_ROUND_ROBIN,
 			ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
 			EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
-				EdsConfig: &core.ConfigSource{
-					ConfigSourceSpecifier: &core.ConfigSource_Ads{},
-				},
+				EdsConfig:   adsConfigSource(),
+				ServiceName: edsServiceName,
 			},
+			TransportSocket:     transportSocket,
+			CircuitBreakers:     circuitBreakers(cfg.CircuitBreaker),
+			OutlierDetection:    outlierDetection(cfg.OutlierDetection),
+			LoadBalancingPolicy: loadBalancingPolicy(cfg.WeightedRoundRobin, cfg.SlowStart.envoy(clusterName)),
 		},
 	}
+	if slowStart := cfg.SlowStart.envoy(clusterName); slowStart != nil {
+		cls[0].(*cluster.Cluster).LbConfig = &cluster.Cluster_RoundRobinLbConfig_{RoundRobinLbConfig: &cluster.Cluster_RoundRobinLbConfig{SlowStartConfig: slowStart}}
+	}
+	if e, dns := dnsEndpoint(zones); dns {
+		logicalDNSCluster(cls[0].(*cluster.Cluster), e)
+	}
 	return cls
 }
 
-func createVirtualHost(virtualHostName, listenerName, clusterName string) *route.VirtualHost {
+func createVirtualHost(virtualHostName string, domains []string, clusterName string, perFilterConfig map[string]*anypb.Any) *route.VirtualHost {
 	zap.L().Debug("Creating RDS", zap.String("host name", virtualHostName))
 	vh := &route.VirtualHost{
 		Name:    virtualHostName,
-		Domains: []string{listenerName},
+		Domains: domains,
 
 		Routes: []*route.Route{{
 			Match: &route.RouteMatch{
@@ -188,13 +410,14 @@ func createVirtualHost(virtualHostName, listenerName, clusterName string) *route
 					},
 				},
 			},
+			TypedPerFilterConfig: perFilterConfig,
 		}}}
 	return vh
 
 }
 
-func createRoute(routeConfigName, virtualHostName, listenerName, clusterName string) []types.Resource {
-	vh := createVirtualHost(virtualHostName, listenerName, clusterName)
+func createRoute(routeConfigName, virtualHostName string, domains []string, clusterName string, perFilterConfig map[string]*anypb.Any) []types.Resource {
+	vh := createVirtualHost(virtualHostName, domains, clusterName, perFilterConfig)
 	rds := []types.Resource{
 		&route.RouteConfiguration{
 			Name:         routeConfigName,
@@ -204,26 +427,23 @@ func createRoute(routeConfigName, virtualHostName, listenerName, clusterName str
 	return rds
 }
 
-func createListener(listenerName string, clusterName string, routeConfigName string) []types.Resource {
+// createListener creates an API listener, the router filter is appended after the given httpFilters
+func createListener(listenerName string, clusterName string, routeConfigName string, httpFilters ...*hcm.HttpFilter) []types.Resource {
 	zap.L().Debug("Creating LISTENER", zap.String("name", listenerName))
 	pbst := any(&hcm.HttpConnectionManager{
 		CodecType: hcm.HttpConnectionManager_AUTO,
 		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
 			Rds: &hcm.Rds{
 				RouteConfigName: routeConfigName,
-				ConfigSource: &core.ConfigSource{
-					ConfigSourceSpecifier: &core.ConfigSource_Ads{
-						Ads: &core.AggregatedConfigSource{},
-					},
-				},
+				ConfigSource:    adsConfigSource(),
 			},
 		},
-		HttpFilters: []*hcm.HttpFilter{{
+		HttpFilters: append(httpFilters, &hcm.HttpFilter{
 			Name: "router",
 			ConfigType: &hcm.HttpFilter_TypedConfig{
 				TypedConfig: any(&v3routerpb.Router{}),
 			},
-		}},
+		}),
 	})
 	lds := []types.Resource{
 		&l.Listener{
@@ -254,6 +474,16 @@ func createListener(listenerName string, clusterName string, routeConfigName str
 	return lds
 }
 
+// adsConfigSource makes clients fetch resources over the same (v3) stream
+func adsConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ResourceApiVersion: core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{
+			Ads: &core.AggregatedConfigSource{},
+		},
+	}
+}
+
 func zoneToRegion(zone string) string {
 	if len(zone) <= 2 {
 		zap.S().Warnf("Invalid zone %q", zone)
@@ -263,9 +493,10 @@ func zoneToRegion(zone string) string {
 	return zone[0 : len(zone)-2]
 }
 
+// any marshals deterministically, so unchanged resources keep the same hash (version)
 func any(m proto.Message) *anypb.Any {
-	a, err := anypb.New(m)
-	if err != nil {
+	a := &anypb.Any{}
+	if err := anypb.MarshalFrom(a, m, proto.MarshalOptions{Deterministic: true}); err != nil {
 		panic(err)
 	}
 	return a
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSnapshotContentVersions(t *testing.T) {
+	node := &core.Node{Id: "client", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	mapping := Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}, {IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-b": {{IP: "10.0.1.1", Port: 8080, Zone: "europe-west4-b"}}},
+	}
+	first, err := GenerateSnapshot(node, mapping, Options{})
+	assert.NoError(t, err)
+
+	// the order of discovery does not matter
+	second, err := GenerateSnapshot(node, Mapping{
+		"b": {"europe-west4-b": {{IP: "10.0.1.1", Port: 8080, Zone: "europe-west4-b"}}},
+		"a": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}, {IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+	}, Options{})
+	assert.NoError(t, err)
+	for _, typ := range []resource.Type{resource.ListenerType, resource.RouteType, resource.ClusterType, resource.EndpointType} {
+		assert.NotEmpty(t, first.GetVersion(typ))
+		assert.Equal(t, first.GetVersion(typ), second.GetVersion(typ), typ)
+	}
+
+	// scaling only changes the endpoints
+	mapping["a"]["europe-west4-a"] = mapping["a"]["europe-west4-a"][:1]
+	third, err := GenerateSnapshot(node, mapping, Options{})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.GetVersion(resource.EndpointType), third.GetVersion(resource.EndpointType))
+	for _, typ := range []resource.Type{resource.ListenerType, resource.RouteType, resource.ClusterType} {
+		assert.Equal(t, first.GetVersion(typ), third.GetVersion(typ), typ)
+	}
+}
+
+func TestGenerateSnapshotAliases(t *testing.T) {
+	mapping := Mapping{"example-server": {"europe-west4-a": {{IP: "10.0.0.1", Port: 9090, Zone: "europe-west4-a", Namespace: "default"}}}}
+	ss, err := GenerateSnapshot(&core.Node{Id: "client"}, mapping, Options{ClusterDomain: "example.com"})
+	assert.NoError(t, err)
+	aliases := []string{
+		"example-server", "example-server:9090",
+		"example-server.default", "example-server.default:9090",
+		"example-server.default.svc.example.com", "example-server.default.svc.example.com:9090",
+	}
+	assert.ElementsMatch(t, aliases, resourceNames(ss.GetResources(resource.ListenerType)))
+	rc := ss.GetResources(resource.RouteType)["example-server-route"].(*route.RouteConfiguration)
+	assert.Equal(t, aliases, rc.VirtualHosts[0].Domains)
+
+	for _, alias := range aliases {
+		assert.Equal(t, "example-server", subscribedService(resource.ListenerType, alias))
+	}
+}
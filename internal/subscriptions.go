@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// Subscriptions tracks the services that the nodes of a class subscribed to, so only their resources are generated.
+// Services are tracked before discovery knows them, so they are generated as soon as they are discovered. The names are
+// tracked per stream, so services are dropped once no open stream requests them.
+type Subscriptions struct {
+	sync.Mutex
+	// streams are the requested names of the open streams, per type
+	streams map[streamKey]map[string]*typeSubscription
+	// services, wildcards, plain and federated count the requests of the streams
+	services map[string]int
+	// wildcards are the wildcard subscriptions, like the ones of Envoy, which subscribe to all services
+	wildcards int
+	// plain and federated tell which styles of resource names are requested
+	plain     int
+	federated int
+	// added and removed tell whether a count started or stopped, while counting
+	added   bool
+	removed bool
+	changed chan struct{}
+	// version counts the changes, generated is the version of the latest generated snapshot
+	version   uint64
+	generated uint64
+	done      chan struct{}
+}
+
+// typeSubscription are the names of a type requested on a stream
+type typeSubscription struct {
+	names    map[string]bool
+	wildcard bool
+}
+
+// Add the requested resource names of the state of the world stream, which replace the names it requested of the type
+// before. Wildcard requests for listeners or clusters subscribe to all services. Fetches, which have no stream, use the
+// zero streamKey. It returns the version to wait for, or 0 if no service was added.
+func (s *Subscriptions) Add(stream streamKey, typeURL string, names []string, wildcard bool) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	s.init()
+	sub := &typeSubscription{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		sub.names[name] = true
+	}
+	previous := s.streams[stream][typeURL]
+	// only the first request of a type subscribes to the wildcard, later ones without names unsubscribe
+	sub.wildcard = wildcard && (previous == nil || previous.wildcard)
+	return s.replace(stream, typeURL, previous, sub)
+}
+
+// Update the requested resource names of the delta stream
+func (s *Subscriptions) Update(stream streamKey, typeURL string, subscribe []string, unsubscribe []string, wildcard bool) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	s.init()
+	previous := s.streams[stream][typeURL]
+	sub := &typeSubscription{names: map[string]bool{}, wildcard: wildcard}
+	if previous != nil {
+		for name := range previous.names {
+			sub.names[name] = true
+		}
+	}
+	for _, name := range subscribe {
+		sub.names[name] = true
+	}
+	for _, name := range unsubscribe {
+		delete(sub.names, name)
+	}
+	return s.replace(stream, typeURL, previous, sub)
+}
+
+// Remove the subscriptions of the closed stream
+func (s *Subscriptions) Remove(stream streamKey) {
+	s.Lock()
+	defer s.Unlock()
+	s.init()
+	s.added, s.removed = false, false
+	for typeURL, sub := range s.streams[stream] {
+		s.count(typeURL, sub, -1)
+	}
+	delete(s.streams, stream)
+	if s.removed {
+		s.notify()
+	}
+}
+
+// replace the previous subscription of the type on the stream, counting the new names first so unchanged services stay
+func (s *Subscriptions) replace(stream streamKey, typeURL string, previous, sub *typeSubscription) uint64 {
+	s.added, s.removed = false, false
+	s.count(typeURL, sub, 1)
+	if previous != nil {
+		s.count(typeURL, previous, -1)
+	}
+	if s.streams[stream] == nil {
+		s.streams[stream] = make(map[string]*typeSubscription)
+	}
+	s.streams[stream][typeURL] = sub
+	if !s.added && !s.removed {
+		return 0
+	}
+	version := s.notify()
+	if !s.added {
+		return 0
+	}
+	return version
+}
+
+// count the names of the subscription up (1) or down (-1)
+func (s *Subscriptions) count(typeURL string, sub *typeSubscription, delta int) {
+	if sub.wildcard && (typeURL == resource.ListenerType || typeURL == resource.ClusterType) {
+		s.counted(&s.wildcards, delta)
+		s.counted(&s.plain, delta)
+	}
+	for name := range sub.names {
+		if _, federated := federatedID(name); federated {
+			s.counted(&s.federated, delta)
+		} else {
+			s.counted(&s.plain, delta)
+		}
+		if service := subscribedService(typeURL, name); service != "" {
+			n := s.services[service]
+			s.counted(&n, delta)
+			if n > 0 {
+				s.services[service] = n
+			} else {
+				delete(s.services, service)
+			}
+		}
+	}
+}
+
+func (s *Subscriptions) counted(n *int, delta int) {
+	*n += delta
+	if delta > 0 && *n == delta {
+		s.added = true
+	} else if delta < 0 && *n == 0 {
+		s.removed = true
+	}
+}
+
+// Version of the subscriptions, to be passed to Generated once the snapshot includes them
+func (s *Subscriptions) Version() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.version
+}
+
+// Generated marks that the snapshot includes the subscriptions up to the version
+func (s *Subscriptions) Generated(version uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.init()
+	if version > s.generated {
+		s.generated = version
+		close(s.done)
+		s.done = make(chan struct{})
+	}
+}
+
+// Wait until the snapshot includes the subscriptions up to the version, so the new resources are in the first response
+func (s *Subscriptions) Wait(ctx context.Context, version uint64) bool {
+	for {
+		s.Lock()
+		s.init()
+		if s.generated >= version {
+			s.Unlock()
+			return true
+		}
+		done := s.done
+		s.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Includes tells if the service is subscribed to, a nil Subscriptions includes all services
+func (s *Subscriptions) Includes(service string) bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.wildcards > 0 || s.services[service] > 0
+}
+
+// namings are the styles of the requested resource names, a nil Subscriptions requests all styles
+func (s *Subscriptions) namings(authority string) []resourceNaming {
+	plain, federated := true, true
+	if s != nil {
+		s.Lock()
+		plain, federated = s.plain > 0, s.federated > 0
+		s.Unlock()
+	}
+	var namings []resourceNaming
+	if plain {
+		namings = append(namings, resourceNaming{})
+	}
+	if federated && authority != "" {
+		namings = append(namings, resourceNaming{authority: authority})
+	}
+	return namings
+}
+
+// Pending lists the subscribed services that are not discovered (yet)
+func (s *Subscriptions) Pending(mapping Mapping) []string {
+	s.Lock()
+	defer s.Unlock()
+	pending := []string{}
+	for service := range s.services {
+		if _, has := mapping[service]; !has {
+			pending = append(pending, service)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// Changed returns a channel that is closed on the next change of the subscribed services
+func (s *Subscriptions) Changed() <-chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+	s.init()
+	return s.changed
+}
+
+// filter the mapping to the subscribed services
+func (s *Subscriptions) filter(mapping Mapping) Mapping {
+	if s == nil {
+		return mapping
+	}
+	filtered := Mapping{}
+	for service, zones := range mapping {
+		if s.Includes(service) {
+			filtered[service] = zones
+		}
+	}
+	return filtered
+}
+
+func (s *Subscriptions) init() {
+	if s.services == nil {
+		s.services = make(map[string]int)
+		s.streams = make(map[streamKey]map[string]*typeSubscription)
+	}
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+		s.done = make(chan struct{})
+	}
+}
+
+func (s *Subscriptions) notify() uint64 {
+	s.version++
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.version
+}
+
+// subscribedService is the service of a plain or xdstp resource name, it is empty for names of inbound listeners
+func subscribedService(typeURL string, name string) string {
+	if id, federated := federatedID(name); federated {
+		if typeURL == resource.ListenerType {
+			return subscribedService(typeURL, id)
+		}
+		if typeURL == resource.ClusterType {
+			return strings.TrimSuffix(id, federatedFailoverSuffix)
+		}
+		return id
+	}
+	switch typeURL {
+	case resource.ListenerType:
+		if strings.Contains(name, "/") {
+			return ""
+		}
+		// aliases like example-server.default.svc.cluster.local:9090
+		if i := strings.IndexAny(name, ".:"); i >= 0 {
+			return name[:i]
+		}
+		return name
+	case resource.RouteType:
+		if strings.HasSuffix(name, "-route") {
+			return strings.TrimSuffix(name, "-route")
+		}
+	case resource.ClusterType, resource.EndpointType:
+		if strings.HasSuffix(name, "-cluster") {
+			return strings.TrimSuffix(name, "-cluster")
+		}
+		if typeURL == resource.ClusterType && strings.HasSuffix(name, failoverSuffix) {
+			return strings.TrimSuffix(name, failoverSuffix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestGenerateSnapshotSubscriptions(t *testing.T) {
+	mapping := Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}},
+	}
+	subscriptions := &Subscriptions{}
+	client, envoy := streamKey{id: 1}, streamKey{id: 2}
+	assert.NotZero(t, subscriptions.Add(client, resource.ListenerType, []string{"a", "grpc/server?xds.resource.listening_address=0.0.0.0:8080"}, false))
+	assert.Zero(t, subscriptions.Add(client, resource.ClusterType, []string{"a-cluster"}, false))
+	assert.NotZero(t, subscriptions.Add(client, resource.EndpointType, []string{"c-cluster"}, false))
+	assert.Equal(t, []string{"c"}, subscriptions.Pending(mapping))
+
+	ss, err := GenerateSnapshot(&core.Node{Id: "client"}, mapping, Options{Subscriptions: subscriptions})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "a:8080"}, resourceNames(ss.GetResources(resource.ListenerType)))
+	assert.Equal(t, []string{"a-cluster"}, resourceNames(ss.GetResources(resource.ClusterType)))
+
+	// wildcard subscriptions of Envoy include all services
+	assert.NotZero(t, subscriptions.Add(envoy, resource.ClusterType, nil, true))
+	ss, err = GenerateSnapshot(&core.Node{Id: "client"}, mapping, Options{Subscriptions: subscriptions})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-cluster", "b-cluster"}, resourceNames(ss.GetResources(resource.ClusterType)))
+
+	// services are dropped once no stream requests them
+	changed := subscriptions.Changed()
+	subscriptions.Remove(envoy)
+	assert.True(t, isClosed(changed))
+	assert.False(t, subscriptions.Includes("b"))
+	assert.True(t, subscriptions.Includes("a"))
+	assert.Zero(t, subscriptions.Add(client, resource.EndpointType, nil, false))
+	assert.Equal(t, []string{}, subscriptions.Pending(mapping))
+	assert.Zero(t, subscriptions.Update(envoy, resource.ClusterType, []string{"a-cluster"}, nil, false))
+	assert.Zero(t, subscriptions.Update(envoy, resource.ClusterType, nil, []string{"a-cluster"}, false))
+	subscriptions.Remove(client)
+	assert.False(t, subscriptions.Includes("a"))
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestXdsOnDemand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9040)
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}},
+	})
+
+	conn, err := grpc.DialContext(ctx, "localhost:9040", grpc.WithInsecure())
+	if !assert.NoError(t, err) {
+		return
+	}
+	stream, err := discoverygrpc.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx, grpc.WaitForReady(true))
+	if !assert.NoError(t, err) {
+		return
+	}
+	node := &core.Node{Id: "on-demand", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	assert.NoError(t, stream.Send(&discoverygrpc.DiscoveryRequest{Node: node, TypeUrl: resource.ListenerType, ResourceNames: []string{"a"}}))
+	resp := recvSotw(t, stream)
+	assert.Len(t, resp.Resources, 1)
+
+	// services that are not discovered yet are sent once discovered
+	assert.NoError(t, stream.Send(&discoverygrpc.DiscoveryRequest{Node: node, TypeUrl: resource.ListenerType, ResourceNames: []string{"a", "c"},
+		VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce}))
+	time.Sleep(100 * time.Millisecond)
+	discovery.Emit(Mapping{
+		"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}},
+		"b": {"europe-west4-a": {{IP: "10.0.0.2", Port: 8080, Zone: "europe-west4-a"}}},
+		"c": {"europe-west4-a": {{IP: "10.0.0.3", Port: 8080, Zone: "europe-west4-a"}}},
+	})
+	resp = recvSotw(t, stream)
+	assert.Len(t, resp.Resources, 2)
+}
+
+func recvSotw(t *testing.T, stream discoverygrpc.AggregatedDiscoveryService_StreamAggregatedResourcesClient) *discoverygrpc.DiscoveryResponse {
+	type result struct {
+		resp *discoverygrpc.DiscoveryResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := stream.Recv()
+		ch <- result{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response")
+		return nil
+	}
+}
+
+func resourceNames(resources map[string]types.Resource) []string {
+	names := []string{}
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
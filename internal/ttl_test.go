@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestXdsEndpointTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	serverCtx, killServer := context.WithCancel(ctx)
+	defer killServer()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9060)
+	config.Set("managementServer.endpointTTL", "1s")
+	config.Set("managementServer.heartbeatInterval", "200ms")
+	discovery := &manualDiscovery{}
+	go Run(serverCtx, config, discovery)
+	discovery.Emit(Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}})
+
+	conn, err := grpc.DialContext(ctx, "localhost:9060", grpc.WithInsecure())
+	if !assert.NoError(t, err) {
+		return
+	}
+	stream, err := discoverygrpc.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx, grpc.WaitForReady(true))
+	if !assert.NoError(t, err) {
+		return
+	}
+	node := &core.Node{Id: "ttl", UserAgentName: "envoy", Locality: &core.Locality{Zone: "europe-west4-a"}}
+	request := &discoverygrpc.DiscoveryRequest{Node: node, TypeUrl: resource.EndpointType, ResourceNames: []string{"a-cluster"}}
+	assert.NoError(t, stream.Send(request))
+
+	// endpoints are sent to Envoy with a TTL, and refreshed by heartbeats without the assignment
+	resp := recvSotw(t, stream)
+	wrapped := &discoverygrpc.Resource{}
+	assert.NoError(t, resp.Resources[0].UnmarshalTo(wrapped))
+	assert.Equal(t, time.Second, wrapped.Ttl.AsDuration())
+	assert.NotNil(t, wrapped.Resource)
+	for i := 0; i < 2; i++ {
+		request.VersionInfo, request.ResponseNonce = resp.VersionInfo, resp.Nonce
+		assert.NoError(t, stream.Send(request))
+		resp = recvSotw(t, stream)
+		assert.NoError(t, resp.Resources[0].UnmarshalTo(wrapped))
+		assert.Equal(t, time.Second, wrapped.Ttl.AsDuration())
+		assert.Nil(t, wrapped.Resource, "heartbeat")
+	}
+
+	lastHeartbeat := time.Now()
+	ttl := wrapped.Ttl.AsDuration()
+
+	// without the management server the stream ends, so no heartbeat refreshes the endpoints and they expire at the client
+	// one TTL after the last heartbeat. gRPC (1.46) does not support TTLs, Envoy expires the endpoints.
+	killServer()
+	request.VersionInfo, request.ResponseNonce = resp.VersionInfo, resp.Nonce
+	stream.Send(request)
+	heartbeats := make(chan *discoverygrpc.DiscoveryResponse, 1)
+	ended := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				ended <- err
+				return
+			}
+			heartbeats <- resp
+		}
+	}()
+	expiry := time.After(time.Until(lastHeartbeat.Add(ttl)))
+	select {
+	case <-heartbeats:
+		t.Fatal("heartbeat after the management server was killed")
+	case err := <-ended:
+		assert.Error(t, err)
+	case <-expiry:
+		t.Fatal("stream still open when the endpoints expire")
+	}
+	// the endpoints are kept until the TTL elapses, and nothing refreshes them before
+	select {
+	case <-heartbeats:
+		t.Fatal("heartbeat after the stream ended")
+	case <-expiry:
+	}
+	assert.GreaterOrEqual(t, time.Since(lastHeartbeat), ttl, "endpoints expired before the TTL elapsed")
+}
+
+func TestGenerateSnapshotEndpointTTL(t *testing.T) {
+	mapping := Mapping{"a": {"europe-west4-a": {{IP: "10.0.0.1", Port: 8080, Zone: "europe-west4-a"}}}}
+	ss, err := GenerateSnapshot(&core.Node{Id: "envoy", UserAgentName: "envoy"}, mapping, Options{EndpointTTL: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, *ss.GetResourcesAndTTL(resource.EndpointType)["a-cluster"].TTL)
+	assert.Nil(t, ss.GetResourcesAndTTL(resource.ClusterType)["a-cluster"].TTL)
+
+	ss, err = GenerateSnapshot(&core.Node{Id: "grpc"}, mapping, Options{EndpointTTL: time.Minute})
+	assert.NoError(t, err)
+	assert.Nil(t, ss.GetResourcesAndTTL(resource.EndpointType)["a-cluster"].TTL)
+}
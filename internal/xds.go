@@ -2,6 +2,9 @@ package internal
 
 import (
 	"context"
+	"expvar"
+	"net/http"
+	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
@@ -18,6 +21,64 @@ func Run(ctx context.Context, config *viper.Viper, d Discovery) {
 		Signal:   signal,
 		Fetches:  0,
 		Requests: 0,
+		// nodes are kept for a while after disconnecting, so reconnecting clients are served from the cache
+		GracePeriod: time.Minute,
+	}
+	if gracePeriod := config.GetDuration("managementServer.nodeGracePeriod"); gracePeriod > 0 {
+		cb.GracePeriod = gracePeriod
+	}
+
+	services, err := ReadServices(config)
+	if err != nil {
+		zap.L().Error("invalid services configuration", zap.Error(err))
+	}
+	security, err := ReadSecurity(config)
+	if err != nil {
+		zap.L().Error("invalid security configuration", zap.Error(err))
+	}
+	descriptors, err := ReadDescriptors(config)
+	if err != nil {
+		zap.L().Error("invalid descriptors", zap.Error(err))
+	}
+	faults, err := NewFaults(config)
+	if err != nil {
+		zap.L().Error("invalid fault experiments", zap.Error(err))
+	}
+	// the control plane probes the endpoints when a health check interval is configured
+	health, err := NewHealthChecker(config, services, security)
+	if err != nil {
+		zap.L().Error("invalid health check configuration", zap.Error(err))
+	}
+	// clients report their loads when an interval is configured
+	var loads *LoadReportingServer
+	if interval := config.GetDuration("managementServer.loadReportingInterval"); interval > 0 {
+		loads = &LoadReportingServer{Interval: interval}
+		publishLoads(loads)
+	}
+	if adminPort := config.GetInt("admin.port"); adminPort > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/faults", faults)
+		if loads != nil {
+			mux.Handle("/loads", loads)
+		}
+		if health != nil {
+			mux.Handle("/healthchecks", health)
+		}
+		mux.Handle("/debug/vars", expvar.Handler())
+		go RunAdminServer(ctx, requireToken(config.GetString("admin.token"), mux), config.GetString("admin.address"), uint(adminPort))
+	}
+
+	clusterDomain := config.GetString("clusterDomain")
+	// clients federating multiple control planes request xdstp names of the authority
+	authority := config.GetString("authority")
+	// clients reach the RouteLookupService of the control plane at its address, a gRPC target like dns:///k8s-xds:9000
+	routeLookupService := config.GetString("managementServer.address")
+
+	// endpoints expire at clients that stop receiving heartbeats, e.g. when the control plane is gone
+	endpointTTL := config.GetDuration("managementServer.endpointTTL")
+	heartbeatInterval := config.GetDuration("managementServer.heartbeatInterval")
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = endpointTTL / 3
 	}
 
 	go func() {
@@ -26,33 +87,84 @@ func Run(ctx context.Context, config *viper.Viper, d Discovery) {
 			zap.L().Fatal("discovery crashed", zap.Error(err))
 		}
 	}()
+	if health != nil {
+		go health.Run(ctx, d)
+	}
 
 	filterCache := &FilterCache{
-		createFn: func(node *core.Node) cache.SnapshotCache {
-			zap.L().Info("Creating Node", zap.String("Id", node.Id))
-			// ads=false to disable ADS: otherwise the xDS server will wait with responding until the
+		ctx: ctx,
+		createFn: func(ctx context.Context, node *core.Node, subscriptions *Subscriptions) cache.SnapshotCache {
+			// the snapshots are shared by all nodes of the class
+			class := classOf(node)
+			zap.L().Info("Creating Node class", zap.String("Id", node.Id), zap.Stringer("class", class))
+			// ads=false to allow partial subscriptions: otherwise the xDS server will wait with responding until the
 			// xDS client lists all resource names (which it never will if it just utilizes a subset)
 			// link: https://github.com/grpc/grpc-go/issues/5131#issuecomment-1022434793
-			snapshotCache := cache.NewSnapshotCache(false, cache.IDHash{}, xdsLog())
-			stream := d.Watch()
+			// ADS clients still get their changes in order, each at its own pace, see classCache
+			var snapshots cache.SnapshotCache
+			if endpointTTL > 0 {
+				snapshots = cache.NewSnapshotCacheWithHeartbeating(ctx, false, idHash{}, xdsLog(), heartbeatInterval)
+			} else {
+				snapshots = cache.NewSnapshotCache(false, idHash{}, xdsLog())
+			}
+			snapshotCache := &classCache{SnapshotCache: snapshots, ctx: ctx, class: class.String(), ads: &cb.ads}
+			stream := d.Watch(ctx)
 			go func() {
+				var m Mapping
+				// fires at the next weight step of slow starting endpoints
+				var slowStart <-chan time.Time
 				for {
-					m := <-stream
-					zap.L().Debug("New mapping", zap.Any("mapping", m))
-					ss, err := GenerateSnapshot(node, m)
+					select {
+					case <-ctx.Done():
+						return
+					case m = <-stream:
+						zap.L().Debug("New mapping", zap.Any("mapping", m))
+					case <-faults.Changed():
+						if m == nil {
+							continue
+						}
+						zap.L().Debug("Fault experiments changed", zap.Stringer("class", class))
+					case <-health.Changed():
+						if m == nil {
+							continue
+						}
+						zap.L().Debug("Health of endpoints changed", zap.Stringer("class", class))
+					case <-slowStart:
+						zap.L().Debug("Slow start weights changed", zap.Stringer("class", class))
+					case <-subscriptions.Changed():
+						if m == nil {
+							// there is no snapshot to update yet, the watches wait for the first one
+							subscriptions.Generated(subscriptions.Version())
+							continue
+						}
+						zap.L().Debug("Subscriptions changed", zap.Stringer("class", class), zap.Strings("pending", subscriptions.Pending(m)))
+					}
+					version := subscriptions.Version()
+					now := time.Now()
+					ss, err := generateSnapshot(class, m, Options{Services: services, Security: security, Faults: faults.Active(), ClusterDomain: clusterDomain, Authority: authority, RouteLookupService: routeLookupService, LoadReporting: loads != nil, Health: health, Now: now, EndpointTTL: endpointTTL, Subscriptions: subscriptions, Descriptors: descriptors})
 					if err != nil {
 						zap.L().Error("Error in Generating the SnapShot", zap.Error(err))
 						return
 					}
-					snapshotCache.SetSnapshot(ctx, node.Id, ss)
+					snapshotCache.SetSnapshot(ctx, class.String(), ss)
+					// Envoy ramps up the endpoints itself
+					slowStart = nil
+					if next := nextSlowStartStep(m, services, now); !next.IsZero() && !class.Envoy {
+						slowStart = time.After(next.Sub(now))
+					}
+					subscriptions.Generated(version)
 				}
 			}()
 			return snapshotCache
 		},
 	}
 
+	cb.Release = filterCache.Release
+	cb.Closed = filterCache.Closed
+	filterCache.streamOf = cb.streamOf
+
 	srv := xds.NewServer(ctx, filterCache, cb)
-	RunManagementServer(ctx, srv, uint(config.GetInt("managementServer.port")), uint32(config.GetInt("maxConcurrentStreams")))
+	RunManagementServer(ctx, srv, &RouteLookupServer{Services: services}, loads, uint(config.GetInt("managementServer.port")), uint32(config.GetInt("maxConcurrentStreams")))
 }
 
 func Contains(sl []string, str string) bool {
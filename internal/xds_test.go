@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +15,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/xds"
 )
 
@@ -36,7 +42,7 @@ func TestXds(t *testing.T) {
 	config.Set("maxConcurrentStreams", 1000)
 	config.Set("managementServer.port", 9000)
 	config.Set("upstreamServices", []string{"example-server"})
-	discovery := &MockDiscovery{filePath: "!manual!"}
+	discovery := &manualDiscovery{}
 	go Run(ctx, config, discovery)
 	time.Sleep(time.Second)
 
@@ -62,14 +68,23 @@ func TestXds(t *testing.T) {
 		log.Fatal(err.Error())
 	}
 
-	assert.Equal(t, "Hi hello world from 8000", runClient(ctx, c))
+	// the client prefers its own zone (europe-west4-a), once it is connected to its endpoint
+	awaitServer(ctx, t, c, 8000)
+	// the other zones have a weight of 1 against 1000, so nearly all calls stay in the own zone
+	own := 0
+	for i := 0; i < 20; i++ {
+		if runClient(ctx, c) == "Hi hello world from 8000" {
+			own++
+		}
+	}
+	assert.GreaterOrEqual(t, own, 18)
 
 	discovery.Emit(map[string]map[string][]podEndPoint{
 		"example-server": {
 			"europe-west4-b": {{IP: "127.0.0.1", Port: 8001, Zone: "europe-west4-b"}},
 		},
 	})
-	time.Sleep(100 * time.Millisecond)
+	awaitServer(ctx, t, c, 8001)
 	assert.Equal(t, "Hi hello world from 8001", runClient(ctx, c))
 
 	discovery.Emit(map[string]map[string][]podEndPoint{
@@ -77,11 +92,65 @@ func TestXds(t *testing.T) {
 			"europe-west4-c": {{IP: "127.0.0.1", Port: 8002, Zone: "europe-west4-c"}},
 		},
 	})
-	time.Sleep(100 * time.Millisecond)
+	awaitServer(ctx, t, c, 8002)
 	assert.Equal(t, "Hi hello world from 8002", runClient(ctx, c))
 
 }
 
+func TestXdsServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := viper.New()
+	config.Set("maxConcurrentStreams", 1000)
+	config.Set("managementServer.port", 9010)
+	config.Set("upstreamServices", []string{"example-server"})
+	config.Set("services", map[string]interface{}{
+		"example-server": map[string]interface{}{
+			"port":          8010,
+			"authorization": []map[string]interface{}{{"name": "example", "methods": []string{"/example.v1.Example/"}}},
+		},
+	})
+	discovery := &manualDiscovery{}
+	go Run(ctx, config, discovery)
+	discovery.Emit(Mapping{"example-server": {}})
+
+	bootstrap, err := os.ReadFile("../example/bootstrap-server.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	bootstrap = []byte(strings.Replace(string(bootstrap), "localhost:9000", "localhost:9010", 1))
+	serving := make(chan struct{})
+	grpcServer := xds.NewGRPCServer(
+		xds.BootstrapContentsForTesting(bootstrap),
+		xds.ServingModeCallback(func(addr net.Addr, args xds.ServingModeChangeArgs) {
+			if args.Mode == connectivity.ServingModeServing {
+				close(serving)
+			}
+		}),
+	)
+	defer grpcServer.Stop()
+	examplev1.RegisterExampleServer(grpcServer, example{port: 8010})
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	lis, err := net.Listen("tcp", ":8010")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go grpcServer.Serve(lis)
+	select {
+	case <-serving:
+	case <-time.After(5 * time.Second):
+		t.Fatal("xDS server did not start serving")
+	}
+
+	c, err := grpc.DialContext(ctx, "localhost:8010", grpc.WithInsecure())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Hi hello world from 8010", runClient(ctx, c))
+	_, err = healthpb.NewHealthClient(c).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
 func runServer(port int) {
 	grpcServer := grpc.NewServer()
 	examplev1.RegisterExampleServer(grpcServer, example{port: port})
@@ -102,6 +171,15 @@ func (e example) DoSomething(ctx context.Context, req *examplev1.ExampleRequest)
 	return &examplev1.ExampleResponse{Message: fmt.Sprintf("Hi %s from %d", req.Name, e.port)}, nil
 }
 
+// awaitServer calls the service until the server at the port answers, as clients only pick the endpoints they are connected to
+func awaitServer(ctx context.Context, t *testing.T, c grpc.ClientConnInterface, port int) bool {
+	want := fmt.Sprintf("Hi hello world from %d", port)
+	return assert.Eventually(t, func() bool {
+		resp, err := examplev1.NewExampleClient(c).DoSomething(ctx, &examplev1.ExampleRequest{Name: "hello world"})
+		return err == nil && resp.Message == want
+	}, 10*time.Second, 10*time.Millisecond, "no answer from %d", port)
+}
+
 func runClient(ctx context.Context, c grpc.ClientConnInterface) string {
 	resp, err := examplev1.NewExampleClient(c).DoSomething(ctx, &examplev1.ExampleRequest{
 		Name: "hello world",
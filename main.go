@@ -29,7 +29,11 @@ func main() {
 		zap.L().Fatal(err.Error())
 	}
 
-	internal.Run(ctx, config, &internal.DiscoveryImpl{Fn: internal.KubernetesEndpointWatch})
+	internal.Run(ctx, config, &internal.DiscoveryImpl{
+		Fn:          internal.KubernetesEndpointWatch,
+		ServiceFn:   internal.KubernetesServiceWatch,
+		DrainPeriod: config.GetDuration("endpointDrainPeriod"),
+	})
 }
 
 // ReadConfig reads the config data from file